@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// agendaLimit bounds the tasks of one section of an agenda.
+	agendaLimit = 100
+	// somedayLimit is the number of tasks without a deadline an agenda shows.
+	somedayLimit = 10
+)
+
+// agendaItem is one line of an agenda. Kind is overdue, due or someday.
+type agendaItem struct {
+	Task
+	Description string
+	Kind        string
+	Group       bool
+}
+
+// agendaDay is the tasks due on one day. Date is its midnight on the wall
+// clock of the user, and Relative is today, tomorrow or empty.
+type agendaDay struct {
+	Date     time.Time
+	Weekday  int
+	Relative string
+	Items    []agendaItem
+}
+
+// Agenda handles /today, /tomorrow, /week and /overdue: the open tasks due in
+// that span, grouped by day in the time zone of the user who asked, see
+// /timezone. /today and /week also show the overdue tasks and a few without a
+// deadline.
+func (bs *BotService) Agenda(ctx context.Context, chatID int64, span string) {
+	var userID int64
+	if o, ok := originFrom(ctx); ok && o.From != nil {
+		userID = o.From.ID
+	}
+	loc := bs.userLocation(ctx, userID)
+	// the span is on the wall clock of the user, the deadlines on the bot's
+	now := wallClock(time.Now().In(loc))
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	var from, to time.Time
+	withOverdue, withSomeday := true, true
+	switch span {
+	case "today":
+		from, to = now, today.AddDate(0, 0, 1)
+	case "tomorrow":
+		from, to = today.AddDate(0, 0, 1), today.AddDate(0, 0, 2)
+		withOverdue, withSomeday = false, false
+	case "week":
+		from, to = now, today.AddDate(0, 0, 7)
+	case "overdue":
+		withSomeday = false
+	default:
+		slog.ErrorContext(ctx, "Unknown agenda span", "span", span)
+		return
+	}
+
+	group := chatID < 0
+	item := func(task Task, kind string) agendaItem {
+		if !task.Deadline.IsZero() {
+			task.Deadline = bs.toZone(task.Deadline, loc)
+		}
+		return agendaItem{Task: task, Description: truncate(task.Description, 200), Kind: kind, Group: group}
+	}
+
+	var overdue []agendaItem
+	moreOverdue := false
+	if withOverdue {
+		filter := bson.M{"chat_id": chatID, "mark": false, "deadline": bson.M{"$gt": time.Time{}, "$lt": bs.wallNow()}}
+		tasks, more, err := bs.agendaTasks(ctx, filter)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list overdue tasks", "error", err)
+			bs.reply(ctx, chatID, "agenda.failed", nil)
+			return
+		}
+		for _, task := range tasks {
+			overdue = append(overdue, item(task, "overdue"))
+		}
+		moreOverdue = more
+	}
+
+	var days []agendaDay
+	moreDue := false
+	if !from.IsZero() {
+		filter := bson.M{"chat_id": chatID, "mark": false, "deadline": bson.M{"$gte": bs.fromZone(from, loc), "$lt": bs.fromZone(to, loc)}}
+		tasks, more, err := bs.agendaTasks(ctx, filter)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list tasks due", "error", err)
+			bs.reply(ctx, chatID, "agenda.failed", nil)
+			return
+		}
+		moreDue = more
+		for _, task := range tasks {
+			d := bs.toZone(task.Deadline.UTC(), loc)
+			date := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
+			if len(days) == 0 || !days[len(days)-1].Date.Equal(date) {
+				day := agendaDay{Date: date, Weekday: int(date.Weekday())}
+				switch {
+				case date.Equal(today):
+					day.Relative = "today"
+				case date.Equal(today.AddDate(0, 0, 1)):
+					day.Relative = "tomorrow"
+				}
+				days = append(days, day)
+			}
+			days[len(days)-1].Items = append(days[len(days)-1].Items, item(task, "due"))
+		}
+	}
+
+	var someday []agendaItem
+	moreSomeday := false
+	if withSomeday {
+		dbCtx, cancel := bs.mongoContext(ctx)
+		findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(somedayLimit + 1)
+		cursor, err := bs.db.Find(dbCtx, bson.M{"chat_id": chatID, "mark": false, "deadline": bson.M{"$lte": time.Time{}}}, findOptions)
+		var tasks []Task
+		if err == nil {
+			err = cursor.All(dbCtx, &tasks)
+		}
+		cancel()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list tasks without deadline", "error", err)
+			bs.reply(ctx, chatID, "agenda.failed", nil)
+			return
+		}
+		if len(tasks) > somedayLimit {
+			tasks, moreSomeday = tasks[:somedayLimit], true
+		}
+		for _, task := range tasks {
+			someday = append(someday, item(task, "someday"))
+		}
+	}
+
+	if len(overdue) == 0 && len(days) == 0 && len(someday) == 0 {
+		bs.reply(ctx, chatID, "agenda.empty", view{"Span": span})
+		return
+	}
+	bs.reply(ctx, chatID, "agenda", view{
+		"Span":        span,
+		"Overdue":     overdue,
+		"MoreOverdue": moreOverdue,
+		"Days":        days,
+		"MoreDue":     moreDue,
+		"Someday":     someday,
+		"MoreSomeday": moreSomeday,
+	})
+}
+
+// agendaTasks returns the first agendaLimit tasks matching filter in the order
+// of their deadlines, and whether there are more. filter has a range on the
+// deadline, which is read through its index rather than going through every
+// task of the chat.
+func (bs *BotService) agendaTasks(ctx context.Context, filter bson.M) ([]Task, bool, error) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "deadline", Value: 1}, {Key: "_id", Value: 1}}).
+		SetHint("deadline").
+		SetLimit(agendaLimit + 1)
+	cursor, err := bs.db.Find(dbCtx, filter, findOptions)
+	if err != nil {
+		return nil, false, err
+	}
+	var tasks []Task
+	if err := cursor.All(dbCtx, &tasks); err != nil {
+		return nil, false, err
+	}
+	if len(tasks) > agendaLimit {
+		return tasks[:agendaLimit], true, nil
+	}
+	return tasks, false, nil
+}
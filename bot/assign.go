@@ -0,0 +1,385 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Assignee is a group member responsible for a task.
+type Assignee struct {
+	ID   int64  `bson:"id" json:"id"`
+	Name string `bson:"name" json:"name"`
+}
+
+func chatMembersKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:members", chatID)
+}
+
+func chatTitleKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:title", chatID)
+}
+
+// rememberMembers records the group's title and the members seen in message.
+// Telegram cannot look a user up by @username, so /assign resolves usernames
+// against the members the bot has seen.
+func (bs *BotService) rememberMembers(ctx context.Context, message *tgbotapi.Message) {
+	if !message.Chat.IsGroup() && !message.Chat.IsSuperGroup() {
+		return
+	}
+	users := append([]tgbotapi.User(nil), message.NewChatMembers...)
+	if message.From != nil {
+		users = append(users, *message.From)
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	pipe := bs.rdb.Pipeline()
+	pipe.Set(redisCtx, chatTitleKey(message.Chat.ID), message.Chat.Title, 0)
+	for _, user := range users {
+		if user.UserName == "" || user.IsBot {
+			continue
+		}
+		member, _ := json.Marshal(Assignee{ID: user.ID, Name: displayName(&user)})
+		pipe.HSet(redisCtx, chatMembersKey(message.Chat.ID), strings.ToLower(user.UserName), member)
+	}
+	if _, err := pipe.Exec(redisCtx); err != nil {
+		slog.ErrorContext(ctx, "Failed to remember group members", "error", err)
+	}
+}
+
+// resolveAssignees finds the members named in message: @usernames the bot has
+// seen, mentions of members without a username, or, when nobody is named, the
+// author of the message being replied to. unknown lists the @usernames not found.
+func (bs *BotService) resolveAssignees(ctx context.Context, message *tgbotapi.Message, args []string) (found []Assignee, unknown []string, err error) {
+	seen := make(map[int64]bool)
+	add := func(a Assignee) {
+		if !seen[a.ID] {
+			seen[a.ID] = true
+			found = append(found, a)
+		}
+	}
+
+	for _, entity := range message.Entities {
+		if entity.Type == "text_mention" && entity.User != nil {
+			add(Assignee{ID: entity.User.ID, Name: displayName(entity.User)})
+		}
+	}
+
+	var usernames []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") && len(arg) > 1 {
+			usernames = append(usernames, arg)
+		}
+	}
+	if len(usernames) > 0 {
+		redisCtx, cancel := bs.redisContext(ctx)
+		defer cancel()
+
+		fields := make([]string, len(usernames))
+		for i, name := range usernames {
+			fields[i] = strings.ToLower(strings.TrimPrefix(name, "@"))
+		}
+		values, err := bs.rdb.HMGet(redisCtx, chatMembersKey(message.Chat.ID), fields...).Result()
+		if err != nil && err != redis.Nil {
+			return nil, nil, err
+		}
+		for i, value := range values {
+			var a Assignee
+			raw, ok := value.(string)
+			if !ok || json.Unmarshal([]byte(raw), &a) != nil {
+				unknown = append(unknown, usernames[i])
+				continue
+			}
+			add(a)
+		}
+	}
+
+	if len(found) == 0 && len(unknown) == 0 {
+		if reply := message.ReplyToMessage; reply != nil && reply.From != nil && !reply.From.IsBot {
+			add(Assignee{ID: reply.From.ID, Name: displayName(reply.From)})
+		}
+	}
+	return found, unknown, nil
+}
+
+// shownTTL is how long the numbers of a listing can be used with /assign.
+const shownTTL = 24 * time.Hour
+
+func chatShownKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:shown", chatID)
+}
+
+// rememberShown records which task each number of a listing in a group stands
+// for, so that /assign N finds the task the group saw as N, whatever order the
+// listing was in. Pages of the same listing add to its numbers; another listing
+// replaces them.
+func (bs *BotService) rememberShown(ctx context.Context, chatID int64, listing string, items []listItem) {
+	if chatID >= 0 || len(items) == 0 {
+		return
+	}
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	key := chatShownKey(chatID)
+	fields := []any{"listing", listing}
+	for _, item := range items {
+		fields = append(fields, strconv.Itoa(item.N), item.ID.Hex())
+	}
+	previous, err := bs.rdb.HGet(redisCtx, key, "listing").Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(ctx, "Failed to get shown tasks", "error", err)
+		return
+	}
+	pipe := bs.rdb.TxPipeline()
+	if previous != listing {
+		pipe.Del(redisCtx, key)
+	}
+	pipe.HSet(redisCtx, key, fields...)
+	pipe.Expire(redisCtx, key, shownTTL)
+	if _, err := pipe.Exec(redisCtx); err != nil {
+		slog.ErrorContext(ctx, "Failed to save shown tasks", "error", err)
+	}
+}
+
+// taskByNumber returns the task shown as number n by the last listing in the
+// chat, or mongo.ErrNoDocuments when that listing has no such number.
+func (bs *BotService) taskByNumber(ctx context.Context, chatID int64, n int) (Task, error) {
+	var task Task
+	redisCtx, cancelRedis := bs.redisContext(ctx)
+	hex, err := bs.rdb.HGet(redisCtx, chatShownKey(chatID), strconv.Itoa(n)).Result()
+	cancelRedis()
+	if err == redis.Nil {
+		return task, mongo.ErrNoDocuments
+	} else if err != nil {
+		return task, err
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return task, mongo.ErrNoDocuments
+	}
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	err = bs.db.FindOne(dbCtx, bson.M{"_id": id, "chat_id": chatID}).Decode(&task)
+	return task, err
+}
+
+// AssignTask handles /assign <number> @user... and /unassign <number> @user...,
+// where number is the one the task has in the last listing shown in the group.
+func (bs *BotService) AssignTask(ctx context.Context, chatID int64, message *tgbotapi.Message, text string, assign bool) {
+	if o, ok := originFrom(ctx); !ok || !o.Group {
+		bs.reply(ctx, chatID, "group_only", nil)
+		return
+	}
+
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		bs.reply(ctx, chatID, "assign.usage", nil)
+		return
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		bs.reply(ctx, chatID, "assign.usage", nil)
+		return
+	}
+
+	assignees, unknown, err := bs.resolveAssignees(ctx, message, args[1:])
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to resolve assignees", "error", err)
+		bs.reply(ctx, chatID, "assign.failed", nil)
+		return
+	}
+	if len(unknown) > 0 {
+		bs.reply(ctx, chatID, "assign.unknown_user", view{"Names": unknown})
+		return
+	}
+	if len(assignees) == 0 {
+		bs.reply(ctx, chatID, "assign.usage", nil)
+		return
+	}
+
+	task, err := bs.taskByNumber(ctx, chatID, n)
+	if err == mongo.ErrNoDocuments {
+		bs.reply(ctx, chatID, "assign.not_found", view{"N": n})
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to find task", "error", err)
+		bs.reply(ctx, chatID, "assign.failed", nil)
+		return
+	}
+
+	filter := bson.M{"chat_id": chatID, "description": task.Description}
+	if _, ok := bs.authorize(ctx, chatID, actionChange, filter); !ok {
+		return
+	}
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	if assign {
+		for _, a := range assignees {
+			// match on the ID only, so a member who renamed is not added twice
+			_, err = bs.db.UpdateOne(dbCtx,
+				bson.M{"chat_id": chatID, "description": task.Description, "assignees.id": bson.M{"$ne": a.ID}},
+				bson.M{"$push": bson.M{"assignees": a}})
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		ids := make([]int64, len(assignees))
+		for i, a := range assignees {
+			ids[i] = a.ID
+		}
+		_, err = bs.db.UpdateOne(dbCtx, filter, bson.M{"$pull": bson.M{"assignees": bson.M{"id": bson.M{"$in": ids}}}})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to update assignees", "error", err)
+		bs.reply(ctx, chatID, "assign.failed", nil)
+		return
+	}
+
+	if assign {
+		bs.reply(ctx, chatID, "assign.done", view{"Description": task.Description, "Assignees": assignees})
+	} else {
+		bs.reply(ctx, chatID, "unassign.done", view{"Description": task.Description, "Assignees": assignees})
+	}
+}
+
+// myItem is a task in /my, with the title of the group it belongs to.
+type myItem struct {
+	Task
+	ChatTitle string
+}
+
+// MyTasks handles /my: the open tasks assigned to the user in every group.
+func (bs *BotService) MyTasks(ctx context.Context, chatID, userID int64) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "chat_id", Value: 1}, {Key: "deadline", Value: 1}}).
+		SetLimit(200)
+	cursor, err := bs.db.Find(dbCtx, bson.M{"assignees.id": userID, "mark": false}, findOptions)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list assigned tasks", "error", err)
+		bs.reply(ctx, chatID, "my.failed", nil)
+		return
+	}
+	defer cursor.Close(dbCtx)
+
+	var tasks []Task
+	if err := cursor.All(dbCtx, &tasks); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode tasks", "error", err)
+		bs.reply(ctx, chatID, "my.failed", nil)
+		return
+	}
+	if len(tasks) == 0 {
+		bs.reply(ctx, chatID, "my.empty", nil)
+		return
+	}
+
+	titles := bs.chatTitles(ctx, tasks)
+	items := make([]myItem, len(tasks))
+	for i, task := range tasks {
+		items[i] = myItem{Task: task, ChatTitle: titles[task.ChatID]}
+	}
+	bs.reply(ctx, chatID, "my", items)
+}
+
+func (bs *BotService) chatTitles(ctx context.Context, tasks []Task) map[int64]string {
+	var keys []string
+	var chats []int64
+	for _, task := range tasks {
+		if len(chats) == 0 || chats[len(chats)-1] != task.ChatID {
+			chats = append(chats, task.ChatID)
+			keys = append(keys, chatTitleKey(task.ChatID))
+		}
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	titles := make(map[int64]string, len(chats))
+	values, err := bs.rdb.MGet(redisCtx, keys...).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get chat titles", "error", err)
+		return titles
+	}
+	for i, value := range values {
+		if title, ok := value.(string); ok {
+			titles[chats[i]] = title
+		}
+	}
+	return titles
+}
+
+// AssigneeStats handles /team_stats: open, done and overdue tasks per assignee
+// of the group.
+func (bs *BotService) AssigneeStats(ctx context.Context, chatID int64) {
+	if o, ok := originFrom(ctx); !ok || !o.Group {
+		bs.reply(ctx, chatID, "group_only", nil)
+		return
+	}
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	now := time.Now()
+	pipeline := []bson.M{
+		{"$match": bson.M{"chat_id": chatID, "assignees.0": bson.M{"$exists": true}}},
+		{"$unwind": "$assignees"},
+		{"$group": bson.M{
+			"_id":   "$assignees.id",
+			"name":  bson.M{"$last": "$assignees.name"},
+			"total": bson.M{"$sum": 1},
+			"done":  bson.M{"$sum": bson.M{"$cond": bson.A{"$mark", 1, 0}}},
+			"overdue": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$and": bson.A{
+				bson.M{"$not": bson.A{"$mark"}},
+				bson.M{"$gt": bson.A{"$deadline", time.Time{}}},
+				bson.M{"$lt": bson.A{"$deadline", now}},
+			}}, 1, 0}}},
+		}},
+		{"$sort": bson.D{{Key: "total", Value: -1}, {Key: "name", Value: 1}}},
+	}
+
+	cursor, err := bs.db.Aggregate(dbCtx, pipeline)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to execute aggregation pipeline", "error", err)
+		bs.reply(ctx, chatID, "team_stats.failed", nil)
+		return
+	}
+	defer cursor.Close(dbCtx)
+
+	var results []struct {
+		ID      int64  `bson:"_id"`
+		Name    string `bson:"name"`
+		Total   int    `bson:"total"`
+		Done    int    `bson:"done"`
+		Overdue int    `bson:"overdue"`
+	}
+	if err := cursor.All(dbCtx, &results); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode aggregation results", "error", err)
+		bs.reply(ctx, chatID, "team_stats.failed", nil)
+		return
+	}
+	if len(results) == 0 {
+		bs.reply(ctx, chatID, "team_stats.empty", nil)
+		return
+	}
+	bs.reply(ctx, chatID, "team_stats", results)
+}
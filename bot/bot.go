@@ -3,31 +3,52 @@ package bot
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
+	"log/slog"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/fatih/color"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	asynq "github.com/hibiken/asynq"
 	redis "github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go_mod/logging"
+	"go_mod/metrics"
+	"go_mod/outbox"
+	"go_mod/tracing"
 )
 
 //TODO: пользователь может сам устанавливать периодичность напоминаний
 
 type Task struct {
-	ChatID         int64     `bson:"chat_id"`
-	Description    string    `bson:"description"`
-	CreatedAt      time.Time `bson:"created_at"`
-	Deadline       time.Time `bson:"deadline"`
-	Mark           bool      `bson:"mark"`
-	ReminderExists bool      `bson:"reminder"`
-	Difficulty     int       `bson:"difficulty"`
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	ChatID         int64              `bson:"chat_id"`
+	Description    string             `bson:"description"`
+	CreatedAt      time.Time          `bson:"created_at"`
+	Deadline       time.Time          `bson:"deadline"`
+	Mark           bool               `bson:"mark"`
+	ReminderExists bool               `bson:"reminder"`
+	Difficulty     int                `bson:"difficulty"`
+	// CreatedBy is the Telegram user who added the task, CreatedByName their name
+	// at that time. Both are empty for tasks added before groups were supported.
+	CreatedBy     int64  `bson:"created_by,omitempty"`
+	CreatedByName string `bson:"created_by_name,omitempty"`
+	// Assignees are the group members responsible for the task, see /assign.
+	Assignees []Assignee `bson:"assignees,omitempty"`
+	// CompletedAt is when the task was marked done, and CompletedBy who did it.
+	CompletedAt     time.Time `bson:"completed_at,omitempty"`
+	CompletedBy     int64     `bson:"completed_by,omitempty"`
+	CompletedByName string    `bson:"completed_by_name,omitempty"`
+	// Tags are the lowercase #words given when the task was added.
+	Tags []string `bson:"tags,omitempty"`
 }
 
 type TaskStatistics struct {
@@ -36,374 +57,754 @@ type TaskStatistics struct {
 	AverageDeadlineDays float64
 }
 
+// ReminderTaskType is the asynq task type handled by HandleReminderTask.
+const ReminderTaskType = "reminder:send"
+
 type ReminderTask struct {
 	ChatID int64  `json:"chat_id"`
 	Text   string `json:"text"`
+	// TraceContext carries the enqueuing span so the reminder handler continues its trace.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
 }
 
 type BotService struct {
 	api         *tgbotapi.BotAPI
 	db          *mongo.Collection
 	rdb         *redis.Client
-	redisCtx    context.Context
 	clientAsynq *asynq.Client
+	outbox      *outbox.Outbox
+	opts        Options
+}
+
+type Options struct {
+	// MongoTimeout and RedisTimeout bound every storage call made on behalf of a single operation.
+	MongoTimeout time.Duration
+	RedisTimeout time.Duration
+	// CommandStateTTL is how long a command waits for its arguments in a follow-up message.
+	CommandStateTTL time.Duration
+	// Location is the time zone deadlines are checked in.
+	Location *time.Location
+	Limits   Limits
+	// PageSize is the number of tasks on one page of /list.
+	PageSize int
+	// DefaultLanguage is used when neither the user nor their Telegram client
+	// asks for a language the bot has a catalog for.
+	DefaultLanguage string
+	// CalendarURL is the public address of the HTTP server that serves calendar
+	// feeds, see CalendarHandler. Empty turns /calendar off.
+	CalendarURL string
 }
 
-func NewBotService(api *tgbotapi.BotAPI, db *mongo.Collection, redisClient *redis.Client, clientAsynq *asynq.Client) *BotService {
+func NewBotService(api *tgbotapi.BotAPI, db *mongo.Collection, redisClient *redis.Client, clientAsynq *asynq.Client, sender *outbox.Outbox, opts Options) *BotService {
+	if opts.CommandStateTTL <= 0 {
+		opts.CommandStateTTL = time.Minute
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	deadlineZone.Store(opts.Location)
 	return &BotService{
 		api:         api,
 		db:          db,
 		rdb:         redisClient,
-		redisCtx:    context.Background(),
 		clientAsynq: clientAsynq,
+		outbox:      sender,
+		opts:        opts,
+	}
+}
+
+func (bs *BotService) mongoContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, bs.opts.MongoTimeout)
+}
+
+func (bs *BotService) redisContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, bs.opts.RedisTimeout)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, timeout)
 }
 
-func (bs *BotService) HandleCommand(message *tgbotapi.Message, client *asynq.Client) {
+func (bs *BotService) HandleCommand(ctx context.Context, message *tgbotapi.Message, client *asynq.Client) {
 	chatID := message.Chat.ID
+	bs.rememberMembers(ctx, message)
+	if bs.ignoreInGroup(message) && !bs.addedToGroup(message) {
+		return
+	}
 	command := message.Command()
 	text := message.CommandArguments()
+	ctx = logging.With(ctx, "command", command)
+	ctx = withOrigin(ctx, message)
+
+	label := commandLabel(command)
+	metrics.UpdatesReceived.WithLabelValues(label).Inc()
+	defer func(start time.Time) {
+		metrics.HandlerDuration.WithLabelValues(label).Observe(metrics.Since(start))
+	}(time.Now())
+
+	ctx, span := tracing.Start(ctx, "command."+label, attribute.Int64("chat_id", chatID))
+	defer span.End()
+
+	var userID int64
+	var languageCode string
+	if message.From != nil {
+		userID = message.From.ID
+		languageCode = message.From.LanguageCode
+	}
+	ctx = withLanguage(ctx, bs.resolveLanguage(ctx, chatID, userID, languageCode))
+	if !bs.allowCommand(ctx, chatID, userID, bs.limitedCommand(ctx, message)) {
+		return
+	}
 
 	switch command {
 	case "start":
-		bs.RunSettedCommand(chatID, "start")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "start")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "start" {
-			bs.SendMessage(chatID, "Привет! Я бот, который поможет тебе управлять задачами. Используй /help для просмотра доступных команд.")
+			bs.reply(ctx, chatID, "start", nil)
 		}
 	case "help":
-		bs.RunSettedCommand(chatID, "help")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "help")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "help" {
-			bs.SendMessage(chatID, "Доступные команды:\n/add <описание задачи> | <сложность задачи> - добавить задачу\n/list - список задач\n/list_by_deadline - список задач сортированный по дедлайну\n/delete <дата и время в формате YYYY-MM-DD HH:MM> - удалить задачу\n/is_done <текст задачи> - отметить задачу, как выполненную\n/edit <старое описание задачи> | <новое описание задачи>\n/set_deadline <описание задачи> | <дата и время в формате YYYY-MM-DD HH:MM>\n/set_reminder <описание задачи> - установить напоминание\n/unset_reminder <описание задачи> - отменить напоминание\n/stats - просмотр общей статистики\n/analyze - статистика по задачам разной сложности\n/help - помощь")
+			bs.reply(ctx, chatID, "help", nil)
 		}
 	case "add":
-		bs.RunSettedCommand(chatID, "add")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "add")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "add" {
-			bs.AddTask(chatID, text)
+			bs.AddTask(ctx, chatID, text)
 		}
 	case "set_deadline":
-		bs.RunSettedCommand(chatID, "set_deadline")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "set_deadline")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "set_deadline" {
-			bs.SetDeadline(chatID, text)
+			bs.SetDeadline(ctx, chatID, text)
 		}
 	case "list":
-		bs.RunSettedCommand(chatID, "list")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "list")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "list" {
-			bs.ListTasks(chatID)
+			bs.ListTasks(ctx, chatID, text)
 		}
 	case "list_by_deadline":
-		bs.RunSettedCommand(chatID, "list_by_deadline")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "list_by_deadline")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "list_by_deadline" {
-			bs.ListTasksByDeadline(chatID)
+			bs.ListTasksByDeadline(ctx, chatID)
 		}
 	case "delete":
-		bs.RunSettedCommand(chatID, "delete")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "delete")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "delete" {
-			bs.DeleteTask(chatID, text)
+			bs.DeleteTask(ctx, chatID, text)
 		}
 	case "edit":
-		bs.RunSettedCommand(chatID, "edit")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "edit")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "edit" {
-			bs.EditTask(chatID, text)
+			bs.EditTask(ctx, chatID, text)
 		}
 	case "is_done":
-		bs.RunSettedCommand(chatID, "is_done")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "is_done")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "is_done" {
-			bs.IsDone(chatID, text)
+			bs.IsDone(ctx, chatID, text)
 		}
 	case "set_reminder":
-		bs.RunSettedCommand(chatID, "set_reminder")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "set_reminder")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "set_reminder" {
-			bs.SetReminder(chatID, text, true, client)
+			bs.SetReminder(ctx, chatID, text, true, client)
 		}
 	case "unset_reminder":
-		bs.RunSettedCommand(chatID, "unset_reminder")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "unset_reminder")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "unset_reminder" {
-			bs.SetReminder(chatID, text, false, client)
+			bs.SetReminder(ctx, chatID, text, false, client)
 		}
 	case "stats":
-		bs.RunSettedCommand(chatID, "stats")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "stats")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "stats" {
-			bs.ShowStats(chatID)
+			bs.ShowStats(ctx, chatID)
 		}
 	case "analyze":
-		bs.RunSettedCommand(chatID, "analyze")
-		state, err := bs.GetCommandState(chatID)
+		bs.RunSettedCommand(ctx, chatID, "analyze")
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 			return
 		}
 		if state == "analyze" {
-			bs.AnalyzeTasks(chatID)
+			bs.AnalyzeTasks(ctx, chatID)
+		}
+	case "language":
+		bs.RunSettedCommand(ctx, chatID, "language")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "language" {
+			bs.SetLanguage(ctx, chatID, userID, languageCode, text)
+		}
+	case "timezone":
+		bs.RunSettedCommand(ctx, chatID, "timezone")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "timezone" {
+			bs.SetTimezone(ctx, chatID, userID, text)
+		}
+	case "ban":
+		bs.RunSettedCommand(ctx, chatID, "ban")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "ban" {
+			bs.BanUser(ctx, chatID, userID, text)
+		}
+	case "unban":
+		bs.RunSettedCommand(ctx, chatID, "unban")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "unban" {
+			bs.UnbanUser(ctx, chatID, userID, text)
+		}
+	case "reminders":
+		bs.RunSettedCommand(ctx, chatID, "reminders")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "reminders" {
+			bs.SetReminderMode(ctx, chatID, text)
+		}
+	case "assign":
+		bs.RunSettedCommand(ctx, chatID, "assign")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "assign" {
+			bs.AssignTask(ctx, chatID, message, text, true)
+		}
+	case "unassign":
+		bs.RunSettedCommand(ctx, chatID, "unassign")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "unassign" {
+			bs.AssignTask(ctx, chatID, message, text, false)
+		}
+	case "my":
+		bs.RunSettedCommand(ctx, chatID, "my")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "my" {
+			bs.MyTasks(ctx, chatID, userID)
+		}
+	case "team_stats":
+		bs.RunSettedCommand(ctx, chatID, "team_stats")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "team_stats" {
+			bs.AssigneeStats(ctx, chatID)
+		}
+	case "role":
+		bs.RunSettedCommand(ctx, chatID, "role")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "role" {
+			bs.SetRole(ctx, chatID, message, text)
+		}
+	case "export":
+		bs.RunSettedCommand(ctx, chatID, "export")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "export" {
+			bs.ExportTasks(ctx, chatID, text)
+		}
+	case "calendar":
+		bs.RunSettedCommand(ctx, chatID, "calendar")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "calendar" {
+			bs.CalendarLink(ctx, chatID, text)
+		}
+	case "today":
+		bs.RunSettedCommand(ctx, chatID, "today")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "today" {
+			bs.Agenda(ctx, chatID, "today")
+		}
+	case "tomorrow":
+		bs.RunSettedCommand(ctx, chatID, "tomorrow")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "tomorrow" {
+			bs.Agenda(ctx, chatID, "tomorrow")
+		}
+	case "week":
+		bs.RunSettedCommand(ctx, chatID, "week")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "week" {
+			bs.Agenda(ctx, chatID, "week")
+		}
+	case "overdue":
+		bs.RunSettedCommand(ctx, chatID, "overdue")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "overdue" {
+			bs.Agenda(ctx, chatID, "overdue")
+		}
+	case "view":
+		bs.RunSettedCommand(ctx, chatID, "view")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "view" {
+			bs.SavedViews(ctx, chatID, text)
+		}
+	case "search":
+		bs.RunSettedCommand(ctx, chatID, "search")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "search" {
+			bs.Search(ctx, chatID, text)
+		}
+	case "import":
+		bs.RunSettedCommand(ctx, chatID, "import")
+		state, err := bs.GetCommandState(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
+			return
+		}
+		if state == "import" {
+			bs.prompt(ctx, chatID, "import.ask", nil)
 		}
 	case "":
+		if bs.addedToGroup(message) {
+			bs.reply(ctx, chatID, "group.welcome", nil)
+			return
+		}
+		if message.Document != nil {
+			bs.ImportFile(ctx, chatID, message.Document)
+			return
+		}
 		textWithoutCommand := message.Text
-		state, err := bs.GetCommandState(chatID)
+		state, err := bs.GetCommandState(ctx, chatID)
 		if err != nil {
-			log.Printf("Failed to get command state: %v", err)
-			bs.SendMessage(chatID, "Произошла ошибка. Пожалуйста, попробуйте заново ввести команду.")
+			slog.ErrorContext(ctx, "Failed to get command state", "error", err)
+			bs.reply(ctx, chatID, "error.retry", nil)
 		}
-		bs.ChooseMethod(chatID, state, textWithoutCommand, client)
+		bs.ChooseMethod(ctx, chatID, state, textWithoutCommand, client)
 	default:
-		bs.SendMessage(chatID, "Неизвестная команда. Используйте /help для просмотра доступных команд.")
+		// in groups a bare /command may be meant for another bot
+		if o, _ := originFrom(ctx); o.Group && !strings.Contains(message.CommandWithAt(), "@") {
+			return
+		}
+		bs.reply(ctx, chatID, "unknown_command", nil)
+	}
+}
+
+var knownCommands = map[string]bool{
+	"start": true, "help": true, "add": true, "set_deadline": true, "list": true,
+	"list_by_deadline": true, "delete": true, "edit": true, "is_done": true,
+	"set_reminder": true, "unset_reminder": true, "stats": true, "analyze": true,
+	"ban": true, "unban": true, "language": true, "timezone": true, "reminders": true,
+	"assign": true, "unassign": true, "my": true, "team_stats": true, "role": true,
+	"export": true, "calendar": true, "import": true, "search": true,
+	"view": true, "today": true, "tomorrow": true, "week": true, "overdue": true,
+}
+
+// commandLabel keeps the metrics label set bounded no matter what users type.
+func commandLabel(command string) string {
+	if command == "" {
+		return "text"
+	}
+	if knownCommands[command] {
+		return command
 	}
+	return "unknown"
 }
 
-func (bs *BotService) RunSettedCommand(chatID int64, command string) {
-	red := color.New(color.FgRed).SprintFunc()
-	err := bs.SetCommandState(chatID, command)
+func (bs *BotService) RunSettedCommand(ctx context.Context, chatID int64, command string) {
+	err := bs.SetCommandState(ctx, chatID, command)
 	if err != nil {
-		log.Println(red("Failed to set command state: %v", err))
-		bs.SendMessage(chatID, "Произошла ошибка при обработке команды. Попробуйте позже.")
+		slog.ErrorContext(ctx, "Failed to set command state", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
 		return
 	}
 }
 
-func (bs *BotService) SetCommandState(userID int64, command string) error {
-	red := color.New(color.FgRed).SprintFunc()
-	key := fmt.Sprintf("user:%d:command", userID)
-	err := bs.rdb.Set(bs.redisCtx, key, command, time.Minute*1).Err()
+func (bs *BotService) SetCommandState(ctx context.Context, userID int64, command string) error {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	key := commandStateKey(ctx, userID)
+	err := bs.rdb.Set(redisCtx, key, command, bs.opts.CommandStateTTL).Err()
 	if err != nil {
-		log.Println(red("Failed to set command state: %v", err))
+		slog.ErrorContext(ctx, "Failed to set command state", "error", err)
 		return err
 	}
 	return nil
 }
 
-func (bs *BotService) GetCommandState(userID int64) (string, error) {
+func (bs *BotService) GetCommandState(ctx context.Context, userID int64) (string, error) {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
 
-	key := fmt.Sprintf("user:%d:command", userID)
-	cmd, err := bs.rdb.Get(bs.redisCtx, key).Result()
+	key := commandStateKey(ctx, userID)
+	cmd, err := bs.rdb.Get(redisCtx, key).Result()
 
 	if err == redis.Nil {
 		return "", nil
 	} else if err != nil {
-		log.Printf("Failed to get command state: %v", err)
+		slog.ErrorContext(ctx, "Failed to get command state", "error", err)
 		return "", err
 	}
 	return cmd, nil
 }
 
-func (bs *BotService) SendMessage(chatID int64, text string) {
-	red := color.New(color.FgRed).SprintFunc()
-	msg := tgbotapi.NewMessage(chatID, text)
-	_, err := bs.api.Send(msg)
-	if err != nil {
-		log.Println(red("Failed to send message: %s", err))
+// SendMessage sends text to chatID, split into several messages if it is longer
+// than Telegram allows.
+func (bs *BotService) SendMessage(ctx context.Context, chatID int64, text string) error {
+	for _, part := range SplitMessage(text, maxMessageLength) {
+		if err := bs.send(ctx, chatID, tgbotapi.NewMessage(chatID, part)); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (bs *BotService) ListTasks(chatID int64) {
-
-	filter := bson.M{"chat_id": chatID}
-	cursor, err := bs.db.Find(context.TODO(), filter)
-	if err != nil {
-		log.Printf("Failed to list tasks: %s", err)
-		bs.SendMessage(chatID, "Не удалось получить список задач.")
-		return
+// send passes c to the outbox. Editing a message to the text it already has is
+// not an error worth logging, it happens whenever a button is pressed twice.
+func (bs *BotService) send(ctx context.Context, chatID int64, c tgbotapi.Chattable) error {
+	method := "sendMessage"
+	switch c.(type) {
+	case tgbotapi.EditMessageTextConfig:
+		method = "editMessageText"
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		method = "editMessageReplyMarkup"
+	case tgbotapi.DocumentConfig:
+		method = "sendDocument"
 	}
-	defer cursor.Close(context.TODO())
-
-	var tasks []Task
-	if err := cursor.All(context.TODO(), &tasks); err != nil {
-		log.Printf("Failed to decode tasks: %s", err)
-		bs.SendMessage(chatID, "Не удалось получить список задач.")
-		return
+	ctx, span := tracing.Start(ctx, "telegram."+method, attribute.Int64("chat_id", chatID))
+	_, err := bs.outbox.Send(ctx, chatID, c)
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		err = nil
+	}
+	tracing.End(span, err)
+	if err != nil {
+		metrics.TelegramSendErrors.Inc()
+		slog.ErrorContext(ctx, "Failed to send message", "error", err)
 	}
+	return err
+}
 
-	if len(tasks) == 0 {
-		bs.SendMessage(chatID, "Список задач пуст.")
+// HandleCallback handles a press on an inline button. Callback data starts with
+// the command the button belongs to, followed by its arguments.
+func (bs *BotService) HandleCallback(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	// answer even when nothing else happens, or the button keeps spinning
+	defer func() {
+		if _, err := bs.api.Request(tgbotapi.NewCallback(query.ID, "")); err != nil {
+			slog.WarnContext(ctx, "Failed to answer callback query", "error", err)
+		}
+	}()
+	if query.Message == nil {
 		return
 	}
+	chatID := query.Message.Chat.ID
+	command, _, _ := strings.Cut(query.Data, ":")
+	ctx = logging.With(ctx, "command", command)
+	ctx = withCallbackOrigin(ctx, query)
 
-	message := "Список задач:\n"
-	for i, task := range tasks {
+	metrics.UpdatesReceived.WithLabelValues("callback").Inc()
+	defer func(start time.Time) {
+		metrics.HandlerDuration.WithLabelValues("callback").Observe(metrics.Since(start))
+	}(time.Now())
 
-		deadlineStr := "-"
-		timeLeftStr := ""
-		timeLeft := time.Until(task.Deadline)
-
-		if !task.Deadline.IsZero() {
-			deadlineStr = task.Deadline.Format("02 Jan 2006 15:04")
-
-			if timeLeft > 0 {
-				days := int(timeLeft.Hours()) / 24
-				hours := int(timeLeft.Hours()) % 24
-				minutes := int(timeLeft.Minutes()) % 60
-				timeLeftStr = fmt.Sprintf(" (Осталось: %d дн. %d ч. %d мин.)", days, hours, minutes)
-			} else {
-				timeLeftStr = " (Просрочено)"
-			}
-		}
+	ctx, span := tracing.Start(ctx, "callback."+command, attribute.Int64("chat_id", chatID))
+	defer span.End()
 
-		if !task.Deadline.IsZero() {
-			deadlineStr = task.Deadline.Format("02 Jan 2006 15:04")
-		}
+	ctx = withLanguage(ctx, bs.resolveLanguage(ctx, chatID, query.From.ID, query.From.LanguageCode))
+	if !bs.allowCommand(ctx, chatID, query.From.ID, command) {
+		return
+	}
 
-		if !task.Mark {
-			message += fmt.Sprintf("%d. %s (Дедлайн: %s)🔥 %s\n", i+1, task.Description, deadlineStr, timeLeftStr)
-		} else {
-			message += fmt.Sprintf("%d. %s (Дедлайн: %s)✅ %s\n", i+1, task.Description, deadlineStr, timeLeftStr)
-		}
+	switch command {
+	case "list":
+		bs.editListPage(ctx, query.Message, query.Data)
+	case "import":
+		bs.ConfirmImport(ctx, query.Message, query.Data == "import:yes")
+	case "pick":
+		bs.PickTask(ctx, query.Message, query.Data)
+	case "dl":
+		bs.PickDeadline(ctx, query.Message, query.Data)
+	default:
+		slog.WarnContext(ctx, "Unknown callback", "data", query.Data)
 	}
-	bs.SendMessage(chatID, message)
 }
 
-func (bs *BotService) DeleteTask(chatID int64, text string) {
+func (bs *BotService) DeleteTask(ctx context.Context, chatID int64, text string) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
 	if text == "" {
-		bs.SendMessage(chatID, "Напишите дедлайн задачи в формате YYYY-MM-DD HH:MM.")
+		bs.prompt(ctx, chatID, "delete.ask", nil)
 		return
 	}
 
 	taskDeadline, err := time.Parse("2006-01-02 15:04", text)
 	if err != nil {
-		log.Printf("Failed to decode tasks: %s", err)
-		bs.SendMessage(chatID, "Неправильный формат.")
+		slog.ErrorContext(ctx, "Failed to decode tasks", "error", err)
+		bs.reply(ctx, chatID, "delete.bad_format", nil)
 		return
 	}
 
 	filter := bson.M{"chat_id": chatID, "deadline": taskDeadline}
+	task, ok := bs.authorize(ctx, chatID, actionDelete, filter)
+	if !ok {
+		return
+	}
+	if task != nil {
+		// several tasks may share the deadline, delete the one that was checked
+		filter = bson.M{"chat_id": chatID, "description": task.Description}
+	}
 
-	result, err := bs.db.DeleteOne(context.TODO(), filter)
+	result, err := bs.db.DeleteOne(dbCtx, filter)
 	if err != nil {
-		log.Printf("Failed to delete task: %s", err)
-		bs.SendMessage(chatID, "Не получилось удалить задачу.")
+		slog.ErrorContext(ctx, "Failed to delete task", "error", err)
+		bs.reply(ctx, chatID, "delete.failed", nil)
 		return
 	}
 
 	if result.DeletedCount == 0 && text != "" {
-		bs.SendMessage(chatID, "Задача не найдена.")
+		bs.reply(ctx, chatID, "delete.not_found", nil)
 		return
 	}
 
-	bs.SendMessage(chatID, "Задача удалена!")
+	bs.reply(ctx, chatID, "delete.done", nil)
 }
 
-func (bs *BotService) AddTask(chatID int64, description string) {
-	if description == "" {
-		bs.SendMessage(chatID, "Пожалуйста, укажите описание задачи.")
+// AddTask handles /add. Every line of the message is a task, with attributes
+// written inline, see parseTaskLine.
+func (bs *BotService) AddTask(ctx context.Context, chatID int64, description string) {
+	if strings.TrimSpace(description) == "" {
+		bs.prompt(ctx, chatID, "task.need_description", nil)
 		return
 	}
-
-	parts := strings.SplitN(description, "|", 2)
-	if len(parts) != 2 {
-		bs.SendMessage(chatID, "Неверный формат команды. Используйте: /add <описание задачи> | <сложность (1-5)>")
+	if _, ok := bs.authorize(ctx, chatID, actionAdd, nil); !ok {
 		return
 	}
 
-	text := strings.TrimSpace(parts[0])
-	difficultyStr := strings.TrimSpace(parts[1])
-
-	difficulty, err := strconv.Atoi(difficultyStr)
-	if err != nil || difficulty < 1 || difficulty > 5 {
-		bs.SendMessage(chatID, "Неверный формат сложности. Используйте число от 1 до 5.")
-		return
+	now := time.Now().In(bs.opts.Location)
+	var rows []importRow
+	for i, line := range strings.Split(description, "\n") {
+		if strings.TrimSpace(line) != "" {
+			rows = append(rows, parseTaskLine(i+1, line, now))
+		}
 	}
 
-	task := Task{
-		ChatID:         chatID,
-		Description:    text,
-		CreatedAt:      time.Now(),
-		Deadline:       time.Time{},
-		Mark:           false,
-		ReminderExists: false,
-		Difficulty:     difficulty,
+	var from *tgbotapi.User
+	if o, ok := originFrom(ctx); ok {
+		from = o.From
+	}
+	err := bs.checkNewRows(ctx, chatID, rows)
+	if err == nil {
+		err = bs.insertRows(ctx, chatID, from, rows)
 	}
-	_, err = bs.db.InsertOne(context.TODO(), task)
 	if err != nil {
-		log.Printf("Failed to insert task: %s", err)
-		bs.SendMessage(chatID, "Не удалось добавить задачу.")
+		slog.ErrorContext(ctx, "Failed to insert tasks", "error", err)
+		bs.reply(ctx, chatID, "add.failed", nil)
 		return
 	}
 
-	bs.SendMessage(chatID, "Задача добавлена!")
+	if len(rows) > 1 {
+		bs.reply(ctx, chatID, "add.report", view{"Summary": summarize(rows), "Rows": rows})
+		return
+	}
+	row := rows[0]
+	switch row.Reason {
+	case "":
+		bs.addDone(ctx, chatID, row.Task)
+	case reasonEmpty:
+		bs.reply(ctx, chatID, "add.usage", nil)
+	case reasonTooLong:
+		bs.reply(ctx, chatID, "add.too_long", view{"Max": bs.opts.Limits.MaxDescriptionLength})
+	case reasonLimit:
+		bs.reply(ctx, chatID, "add.limit", view{"Max": bs.opts.Limits.MaxTasks})
+	default:
+		bs.reply(ctx, chatID, "add.rejected", row)
+	}
 }
 
-func (bs *BotService) EditTask(chatID int64, text string) {
-	if text == "" {
-		bs.SendMessage(chatID, "Пожалуйста, укажите описание старой и новой задачи.")
+// addDone confirms a task added by /add. A task without a deadline gets a
+// button to pick one.
+func (bs *BotService) addDone(ctx context.Context, chatID int64, task Task) {
+	if !task.Deadline.IsZero() {
+		bs.reply(ctx, chatID, "add.done", task)
 		return
 	}
-	parts := strings.SplitN(text, "|", 2)
-	if len(parts) != 2 {
-		bs.SendMessage(chatID, "Неверный формат команды. Используйте: /edit <старое описание задачи>|<новое описание задачи>")
+	lang := bs.language(ctx, chatID)
+	text, err := render(lang, "add.done", task)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "add.done", "error", err)
 		return
 	}
+	button, err := bs.deadlineButton(lang, task)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "picker.open", "error", err)
+		return
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(button))
+	if o, ok := originFrom(ctx); ok && o.Group && o.ChatID == chatID {
+		msg.ReplyToMessageID = o.MessageID
+		msg.AllowSendingWithoutReply = true
+	}
+	bs.send(ctx, chatID, msg)
+}
 
+func (bs *BotService) EditTask(ctx context.Context, chatID int64, text string) {
 	if text == "" {
-		bs.SendMessage(chatID, "Введите текст задачи, которую хотите изменить")
+		bs.prompt(ctx, chatID, "edit.need_both", nil)
+		return
+	}
+	parts := strings.SplitN(text, "|", 2)
+	if len(parts) != 2 {
+		bs.reply(ctx, chatID, "edit.usage", nil)
 		return
 	}
 
@@ -411,35 +812,63 @@ func (bs *BotService) EditTask(chatID int64, text string) {
 	newText := strings.TrimSpace(parts[1])
 
 	if oldText == "" || newText == "" {
-		bs.SendMessage(chatID, "Пожалуйста, укажите старое и новое описание задачи.")
+		bs.prompt(ctx, chatID, "edit.need_both", nil)
+		return
+	}
+
+	task, ok := bs.findTask(ctx, chatID, oldText, pickAction{Command: "edit", Arg: newText}, "task.not_changed")
+	if !ok {
+		return
+	}
+	bs.renameTask(ctx, chatID, task, newText)
+}
+
+// renameTask gives task the description newText, for /edit.
+func (bs *BotService) renameTask(ctx context.Context, chatID int64, task Task, newText string) {
+	if limit := bs.opts.Limits.MaxDescriptionLength; limit > 0 && utf8.RuneCountInString(newText) > limit {
+		bs.reply(ctx, chatID, "add.too_long", view{"Max": limit})
 		return
 	}
 
-	filter := bson.M{"chat_id": chatID, "description": oldText}
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	filter := bson.M{"chat_id": chatID, "description": task.Description}
 	update := bson.M{"$set": bson.M{"description": newText}}
+	if _, ok := bs.authorize(ctx, chatID, actionChange, filter); !ok {
+		return
+	}
 
-	result, err := bs.db.UpdateOne(context.TODO(), filter, update)
+	result, err := bs.db.UpdateOne(dbCtx, filter, update)
 	if err != nil {
-		log.Printf("Failed to find task: %s", err)
+		slog.ErrorContext(ctx, "Failed to find task", "error", err)
 		return
 	}
 
-	if result.ModifiedCount == 0 && text != "" {
-		bs.SendMessage(chatID, "Задача с таким описанием не найдена, или не было изменений.")
+	if result.ModifiedCount == 0 {
+		bs.reply(ctx, chatID, "task.not_changed", nil)
 		return
 	}
 
-	bs.SendMessage(chatID, "Задача успешно изменена!")
+	bs.reply(ctx, chatID, "edit.done", nil)
 }
 
-func (bs *BotService) SetDeadline(chatID int64, text string) {
+func (bs *BotService) SetDeadline(ctx context.Context, chatID int64, text string) {
 	if text == "" {
-		bs.SendMessage(chatID, "Пожалуйста, укажите описание задачи и дедлайн.")
+		bs.prompt(ctx, chatID, "deadline.need", nil)
 		return
 	}
 	parts := strings.SplitN(text, "|", 2)
 	if len(parts) != 2 {
-		bs.SendMessage(chatID, "Неверный формат команды. Используйте: /set_deadline <описание задачи> | <дата в формате YYYY-MM-DD HH:MM>")
+		// no date, pick it on a calendar
+		task, ok := bs.findTask(ctx, chatID, strings.TrimSpace(text), pickAction{Command: "set_deadline"}, "deadline.not_found")
+		if !ok {
+			return
+		}
+		if _, ok := bs.authorize(ctx, chatID, actionChange, bson.M{"chat_id": chatID, "description": task.Description}); !ok {
+			return
+		}
+		bs.showDeadlinePicker(ctx, chatID, task)
 		return
 	}
 
@@ -448,255 +877,357 @@ func (bs *BotService) SetDeadline(chatID int64, text string) {
 
 	deadlineTime, err := time.Parse("2006-01-02 15:04", deadlineStr)
 	if err != nil {
-		bs.SendMessage(chatID, "Неверный формат даты. Используйте формат: YYYY-MM-DD HH:MM")
+		bs.reply(ctx, chatID, "deadline.bad_date", nil)
 		return
 	}
 
-	filter := bson.M{"chat_id": chatID, "description": taskText}
-	update := bson.M{"$set": bson.M{"deadline": deadlineTime}}
-
-	cursor, err := bs.db.Find(context.TODO(), filter)
-	if err != nil {
-		log.Printf("Failed to list tasks: %s", err)
-		bs.SendMessage(chatID, "Не удалось получить список задач.")
+	task, ok := bs.findTask(ctx, chatID, taskText, pickAction{Command: "set_deadline", Arg: deadlineStr}, "deadline.not_found")
+	if !ok {
 		return
 	}
-	defer cursor.Close(context.TODO())
+	bs.setTaskDeadline(ctx, chatID, task, deadlineTime)
+}
 
-	var tasks []Task
-	if err := cursor.All(context.TODO(), &tasks); err != nil {
-		log.Printf("Failed to decode tasks: %s", err)
-		bs.SendMessage(chatID, "Не удалось получить список задач.")
+// setTaskDeadline moves the deadline of task, for /set_deadline.
+func (bs *BotService) setTaskDeadline(ctx context.Context, chatID int64, task Task, deadlineTime time.Time) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	filter := bson.M{"chat_id": chatID, "description": task.Description}
+	update := bson.M{"$set": bson.M{"deadline": deadlineTime}}
+	if _, ok := bs.authorize(ctx, chatID, actionChange, filter); !ok {
 		return
 	}
 
-	result, err := bs.db.UpdateOne(context.TODO(), filter, update)
+	result, err := bs.db.UpdateOne(dbCtx, filter, update)
 	if err != nil {
-		log.Printf("Failed to update task: %s", err)
-		bs.SendMessage(chatID, "Не удалось установить дедлайн.")
+		slog.ErrorContext(ctx, "Failed to update task", "error", err)
+		bs.reply(ctx, chatID, "deadline.failed", nil)
 		return
 	}
 
-	if result.ModifiedCount == 0 && text != "" {
-		bs.SendMessage(chatID, "Задача не найдена или дедлайн не был изменен.")
+	if result.ModifiedCount == 0 {
+		bs.reply(ctx, chatID, "deadline.not_found", nil)
 		return
 	}
-	bs.SendMessage(chatID, "Дедлайн установлен на "+deadlineTime.Format("2006-01-02 15:04")+"!")
+	bs.reply(ctx, chatID, "deadline.set", view{"Deadline": deadlineTime})
 }
 
-func (bs *BotService) IsDone(chatID int64, text string) {
+func (bs *BotService) IsDone(ctx context.Context, chatID int64, text string) {
 	if text == "" {
-		bs.SendMessage(chatID, "Введите описание задачи, которую нужно отметить как выполненную.")
+		bs.prompt(ctx, chatID, "done.ask", nil)
+		return
 	}
-	filter := bson.M{"chat_id": chatID, "description": text}
+	task, ok := bs.findTask(ctx, chatID, text, pickAction{Command: "is_done"}, "task.not_changed")
+	if !ok {
+		return
+	}
+	bs.markDone(ctx, chatID, task)
+}
 
-	_, err := bs.db.Find(context.TODO(), filter)
-	if err != nil {
-		bs.SendMessage(chatID, "Задача с таким описанием не найдена.")
-		log.Printf("Failed to find task: %s", err)
+// markDone marks task done by the user who asked, for /is_done.
+func (bs *BotService) markDone(ctx context.Context, chatID int64, task Task) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	filter := bson.M{"chat_id": chatID, "description": task.Description}
+	if _, ok := bs.authorize(ctx, chatID, actionChange, filter); !ok {
 		return
 	}
 
-	update := bson.M{"$set": bson.M{"mark": true, "reminder": false}}
+	done := bson.M{"mark": true, "reminder": false, "completed_at": time.Now()}
+	if o, ok := originFrom(ctx); ok && o.From != nil {
+		done["completed_by"] = o.From.ID
+		done["completed_by_name"] = displayName(o.From)
+	}
+	update := bson.M{"$set": done}
 
-	result, err := bs.db.UpdateOne(context.TODO(), filter, update)
+	result, err := bs.db.UpdateOne(dbCtx, filter, update)
 	if err != nil {
-		log.Printf("Failed to mark task: %s", err)
+		slog.ErrorContext(ctx, "Failed to mark task", "error", err)
+		bs.reply(ctx, chatID, "task.not_changed", nil)
+		return
 	}
 
-	if result.ModifiedCount == 0 && text != "" {
-		bs.SendMessage(chatID, "Задача с таким описанием не найдена, или не было изменений.")
+	if result.ModifiedCount == 0 {
+		bs.reply(ctx, chatID, "task.not_changed", nil)
 		return
 	} else {
-		bs.SendMessage(chatID, "Задача выполнена!")
+		bs.reply(ctx, chatID, "done.done", nil)
 	}
 }
 
-func (bs *BotService) StartReminder(intervalMinutes int, client *asynq.Client) {
+func (bs *BotService) StartReminder(ctx context.Context, intervalMinutes int, client *asynq.Client) {
 	interval := time.Duration(intervalMinutes) * time.Minute
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		bs.CheckDeadlines(client)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			bs.CheckDeadlines(ctx, client)
+		}
 	}
 }
 
-func (bs *BotService) CheckDeadlines(client *asynq.Client) {
-	yellow := color.New(color.FgYellow).SprintFunc()
-	log.Println(yellow("Checking deadlines..."))
+func (bs *BotService) CheckDeadlines(ctx context.Context, client *asynq.Client) {
+	ctx, span := tracing.Start(ctx, "CheckDeadlines")
+	defer span.End()
+	ctx = outbox.WithPriority(ctx, outbox.Bulk)
+
+	slog.InfoContext(ctx, "Checking deadlines")
+	defer func(start time.Time) {
+		metrics.CheckDeadlinesDuration.Observe(metrics.Since(start))
+	}(time.Now())
 	filter := bson.M{}
 
-	cursor, err := bs.db.Find(context.TODO(), filter)
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	cursor, err := bs.db.Find(dbCtx, filter)
 	if err != nil {
-		log.Printf("Failed to retrieve tasks for deadline check: %v", err)
+		slog.ErrorContext(ctx, "Failed to retrieve tasks for deadline check", "error", err)
 		return
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(dbCtx)
 
 	var tasks []Task
-	if err := cursor.All(context.TODO(), &tasks); err != nil {
-		log.Printf("Failed to decode tasks: %v", err)
+	if err := cursor.All(dbCtx, &tasks); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode tasks", "error", err)
 		return
 	}
 
-	location, err := time.LoadLocation("Europe/Moscow")
-	if err != nil {
-		log.Printf("Failed to load location: %v", err)
-		return
-	}
-
-	now := time.Now().In(location)
+	now := time.Now()
 
+	baseCtx := ctx
 	for _, task := range tasks {
-		timeLeft := time.Until(task.Deadline)
-		timeUntilDead := task.Deadline.Sub(now)
+		if baseCtx.Err() != nil {
+			slog.WarnContext(baseCtx, "Deadline check interrupted", "error", baseCtx.Err())
+			return
+		}
+		ctx := logging.With(baseCtx, "chat_id", task.ChatID)
 
-		if !task.Deadline.IsZero() && task.ReminderExists {
-			days := int(timeLeft.Hours()) / 24
-			hours := int(timeLeft.Hours()) % 24
-			minutes := int(timeLeft.Minutes()) % 60
-			timeUntilDeadline := fmt.Sprintf(" (Осталось: %d дн. %d ч. %d мин.)", days, hours, minutes)
+		deadline := bs.deadlineInstant(task.Deadline)
+		timeUntilDead := deadline.Sub(now)
 
-			if timeUntilDead > 0 {
-				bs.SendMessage(task.ChatID, fmt.Sprintf("Напоминание: Скоро дедлайн по задаче \"%s\"! %s.", task.Description, timeUntilDeadline))
-			}
+		if !task.Deadline.IsZero() && task.ReminderExists && timeUntilDead > 0 {
+			bs.remind(ctx, task, "reminder.soon")
 		}
 		if timeUntilDead <= 0 && !task.Deadline.IsZero() {
-			newDeadline := now.Add(24 * time.Hour)
+			newDeadline := wallClock(now.In(bs.opts.Location)).Add(24 * time.Hour)
 			filter := bson.M{"chat_id": task.ChatID, "description": task.Description}
 			update := bson.M{"$set": bson.M{"deadline": newDeadline}}
 
-			result, err := bs.db.UpdateOne(context.TODO(), filter, update)
+			updateCtx, cancelUpdate := bs.mongoContext(ctx)
+			result, err := bs.db.UpdateOne(updateCtx, filter, update)
+			cancelUpdate()
 			if err != nil {
-				log.Printf("Failed to update task: %s", err)
-				bs.SendMessage(task.ChatID, "Не удалось установить дедлайн.")
+				slog.ErrorContext(ctx, "Failed to update task", "error", err)
+				bs.reply(ctx, task.ChatID, "deadline.failed", nil)
 				return
 			}
 
 			if result.ModifiedCount == 0 {
-				bs.SendMessage(task.ChatID, "Задача не найдена или дедлайн не был изменен.")
+				bs.reply(ctx, task.ChatID, "deadline.not_found", nil)
 				return
 			}
 
-			bs.SendMessage(task.ChatID, fmt.Sprintf("Дедлайн по задаче '%s' истёк. Дедлайн перенесён на завтра", task.Description))
-		} else { //Deadline is still in the future
+			bs.reply(ctx, task.ChatID, "deadline.moved", view{"Description": task.Description, "Deadline": newDeadline})
+		} else if !task.Deadline.IsZero() && task.ReminderExists && !task.Mark { //Deadline is still in the future
 
 			// Enqueue reminder task
-			taskInfo := Task{
-				ChatID:         task.ChatID,
-				Description:    task.Description,
-				CreatedAt:      task.CreatedAt,
-				Deadline:       task.Deadline,
-				Mark:           task.Mark,
-				ReminderExists: task.ReminderExists,
+			taskInfo := ReminderTask{
+				ChatID:       task.ChatID,
+				Text:         task.Description,
+				TraceContext: tracing.Inject(ctx),
 			}
 
 			payload, err := json.Marshal(taskInfo)
 			if err != nil {
-				log.Printf("Failed to marshal task payload: %v", err)
+				slog.ErrorContext(ctx, "Failed to marshal task payload", "error", err)
 				continue // Continue to the next task
 			}
 
-			taskName := "reminder:send"
-			_, err = client.Enqueue(asynq.NewTask(taskName, payload), asynq.ProcessAt(task.Deadline)) //schedule based on existing deadline
+			// one reminder per task and deadline, no matter how many ticks see it
+			taskID := fmt.Sprintf("reminder:%s:%d", task.ID.Hex(), task.Deadline.Unix())
+			_, err = client.EnqueueContext(ctx, asynq.NewTask(ReminderTaskType, payload), asynq.ProcessAt(deadline), asynq.TaskID(taskID)) //schedule based on existing deadline
+			if errors.Is(err, asynq.ErrTaskIDConflict) {
+				continue
+			}
 			if err != nil {
-				log.Printf("Failed to enqueue reminder task: %v", err)
+				metrics.RemindersFailed.WithLabelValues("enqueue").Inc()
+				slog.ErrorContext(ctx, "Failed to enqueue reminder task", "error", err)
 				continue // Continue to the next task
 			}
-			log.Printf("Enqueued reminder task %s for chatID %d with description '%s' to send at %s", taskName, task.ChatID, task.Description, task.Deadline.String())
+			metrics.RemindersEnqueued.Inc()
+			slog.InfoContext(ctx, "Enqueued reminder task", "type", ReminderTaskType, "description", task.Description, "process_at", deadline)
 
 		}
 	}
 }
 
-func (bs *BotService) SetReminder(chatID int64, text string, setReminder bool, client *asynq.Client) {
+func (bs *BotService) SetReminder(ctx context.Context, chatID int64, text string, setReminder bool, client *asynq.Client) {
 	if text == "" {
-		bs.SendMessage(chatID, "Пожалуйста, укажите описание задачи.")
+		bs.prompt(ctx, chatID, "task.need_description", nil)
 		return
 	}
 
+	command := "unset_reminder"
+	if setReminder {
+		command = "set_reminder"
+	}
+	task, ok := bs.findTask(ctx, chatID, text, pickAction{Command: command}, "task.not_changed")
+	if !ok {
+		return
+	}
+	bs.toggleReminder(ctx, chatID, task, setReminder, client)
+}
+
+// toggleReminder turns the reminder of task on or off, for /set_reminder and
+// /unset_reminder.
+func (bs *BotService) toggleReminder(ctx context.Context, chatID int64, task Task, setReminder bool, client *asynq.Client) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	text := task.Description
 	filter := bson.M{"chat_id": chatID, "description": text}
 	update := bson.M{"$set": bson.M{"reminder": setReminder}}
+	if _, ok := bs.authorize(ctx, chatID, actionChange, filter); !ok {
+		return
+	}
 
-	result, err := bs.db.UpdateOne(context.TODO(), filter, update)
+	result, err := bs.db.UpdateOne(dbCtx, filter, update)
 	if err != nil {
-		log.Printf("Failed to remind task: %s", err)
-		bs.SendMessage(chatID, "Не удалось установить/отменить напоминание.")
+		slog.ErrorContext(ctx, "Failed to remind task", "error", err)
+		bs.reply(ctx, chatID, "reminder.toggle_failed", nil)
 		return
 	}
 
-	if result.ModifiedCount == 0 && text != "" {
-		bs.SendMessage(chatID, "Задача с таким описанием не найдена, или не было изменений.")
+	if result.ModifiedCount == 0 {
+		bs.reply(ctx, chatID, "task.not_changed", nil)
 		return
 	}
 
 	if setReminder {
 		task := &ReminderTask{
-			ChatID: chatID,
-			Text:   text,
+			ChatID:       chatID,
+			Text:         text,
+			TraceContext: tracing.Inject(ctx),
 		}
 
-		scheduleAt := time.Now().Add(1 * time.Minute)
+		scheduleAt := time.Now()
 
 		payload, err := json.Marshal(task)
 		if err != nil {
-			log.Printf("Failed to marshal task: %s", err)
-			bs.SendMessage(chatID, "Не удалось установить напоминание.")
+			slog.ErrorContext(ctx, "Failed to marshal task", "error", err)
+			bs.reply(ctx, chatID, "reminder.failed", nil)
 			return
 		}
 
-		_, err = client.Enqueue(asynq.NewTask("reminder:send", payload), asynq.ProcessIn(time.Until(time.Now()))) //time.Until(scheduleAt) вычисляет время, оставшееся до момента, когда должно произойти напоминание, и передает его в функцию asynq.ProcessIn(). Таким образом, задача будет выполнена через одну минуту после установки напоминания.
+		// the first reminder goes out right away, CheckDeadlines queues the one
+		// at the deadline
+		_, err = client.EnqueueContext(ctx, asynq.NewTask(ReminderTaskType, payload), asynq.ProcessAt(scheduleAt))
 		if err != nil {
-			log.Printf("Failed to enqueue reminder task: %s", err)
-			bs.SendMessage(chatID, "Не удалось установить напоминание.")
+			metrics.RemindersFailed.WithLabelValues("enqueue").Inc()
+			slog.ErrorContext(ctx, "Failed to enqueue reminder task", "error", err)
+			bs.reply(ctx, chatID, "reminder.failed", nil)
 			return
 		}
+		metrics.RemindersEnqueued.Inc()
 
 		redisKey := fmt.Sprintf("reminder:%d:%s", chatID, text)
-		err = bs.rdb.Set(bs.redisCtx, redisKey, scheduleAt.Format(time.RFC3339), 0).Err()
+		redisCtx, cancelRedis := bs.redisContext(ctx)
+		err = bs.rdb.Set(redisCtx, redisKey, scheduleAt.Format(time.RFC3339), 0).Err()
+		cancelRedis()
 		if err != nil {
-			log.Printf("Failed to save reminder in Redis: %s", err)
-			bs.SendMessage(chatID, "Не удалось сохранить напоминание.")
+			slog.ErrorContext(ctx, "Failed to save reminder in Redis", "error", err)
+			bs.reply(ctx, chatID, "reminder.save_failed", nil)
 			return
 		}
 
-		bs.SendMessage(chatID, "Напоминание успешно установлено!")
+		bs.reply(ctx, chatID, "reminder.set", nil)
 	} else {
-		bs.SendMessage(chatID, "Напоминание успешно отменено!")
+		bs.reply(ctx, chatID, "reminder.unset", nil)
 	}
 }
 
-func (bs *BotService) ShowStats(chatID int64) {
-	stats, err := bs.GetTaskStatistics(chatID)
+// HandleReminderTask delivers a queued reminder if the task still exists, is not done and
+// still has its reminder enabled.
+func (bs *BotService) HandleReminderTask(ctx context.Context, t *asynq.Task) error {
+	var reminder ReminderTask
+	if err := json.Unmarshal(t.Payload(), &reminder); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	taskID, _ := asynq.GetTaskID(ctx)
+	ctx = logging.With(ctx, "chat_id", reminder.ChatID, "task_id", taskID)
+
+	ctx = tracing.Extract(ctx, reminder.TraceContext)
+	ctx, span := tracing.Tracer().Start(ctx, ReminderTaskType,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.Int64("chat_id", reminder.ChatID), attribute.String("task_id", taskID)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+	ctx = outbox.WithPriority(ctx, outbox.Bulk)
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	var task Task
+	err = bs.db.FindOne(dbCtx, bson.M{"chat_id": reminder.ChatID, "description": reminder.Text}).Decode(&task)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+		return nil
+	} else if err != nil {
+		metrics.RemindersFailed.WithLabelValues("load").Inc()
+		return fmt.Errorf("failed to load task for reminder: %w", err)
+	}
+
+	if task.Mark || !task.ReminderExists {
+		return nil
+	}
+
+	if task.Deadline.IsZero() {
+		err = bs.remind(ctx, task, "reminder.pending")
+	} else {
+		err = bs.remind(ctx, task, "reminder.deadline")
+	}
 	if err != nil {
-		log.Printf("Failed to retrieve statistics: %v", err)
-		bs.SendMessage(chatID, "Не удалось получить статистику.")
-		return
+		metrics.RemindersFailed.WithLabelValues("send").Inc()
+		return fmt.Errorf("failed to send reminder: %w", err)
 	}
+	metrics.RemindersDelivered.Inc()
+	return nil
+}
 
-	message := fmt.Sprintf("Статистика по вашим задачам:\n"+
-		"Выполнено вовремя: %d\n"+
-		"Просрочено: %d\n"+
-		"Средний срок установки дедлайна: %.2f дней\n",
-		stats.CompletedOnTime, stats.Overdue, stats.AverageDeadlineDays)
+func (bs *BotService) ShowStats(ctx context.Context, chatID int64) {
+	stats, err := bs.GetTaskStatistics(ctx, chatID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve statistics", "error", err)
+		bs.reply(ctx, chatID, "stats.failed", nil)
+		return
+	}
 
-	bs.SendMessage(chatID, message)
+	bs.reply(ctx, chatID, "stats", stats)
 }
 
-func (bs *BotService) GetTaskStatistics(chatID int64) (TaskStatistics, error) {
+func (bs *BotService) GetTaskStatistics(ctx context.Context, chatID int64) (TaskStatistics, error) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
 	var stats TaskStatistics
 
 	filter := bson.M{"chat_id": chatID}
 
-	cursor, err := bs.db.Find(context.TODO(), filter)
+	cursor, err := bs.db.Find(dbCtx, filter)
 	if err != nil {
 		return stats, err
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(dbCtx)
 
 	var tasks []Task
-	if err := cursor.All(context.TODO(), &tasks); err != nil {
+	if err := cursor.All(dbCtx, &tasks); err != nil {
 		return stats, err
 	}
 
@@ -726,29 +1257,34 @@ func (bs *BotService) GetTaskStatistics(chatID int64) (TaskStatistics, error) {
 	return stats, nil
 }
 
-func (bs *BotService) ChooseMethod(chatID int64, command string, text string, client *asynq.Client) {
+func (bs *BotService) ChooseMethod(ctx context.Context, chatID int64, command string, text string, client *asynq.Client) {
 	switch command {
 	case "add":
-		bs.AddTask(chatID, text)
+		bs.AddTask(ctx, chatID, text)
 	case "set_deadline":
-		bs.SetDeadline(chatID, text)
+		bs.SetDeadline(ctx, chatID, text)
 	case "list":
-		bs.ListTasks(chatID)
+		bs.ListTasks(ctx, chatID, "")
 	case "delete":
-		bs.DeleteTask(chatID, text)
+		bs.DeleteTask(ctx, chatID, text)
 	case "edit":
-		bs.EditTask(chatID, text)
+		bs.EditTask(ctx, chatID, text)
 	case "is_done":
-		bs.IsDone(chatID, text)
+		bs.IsDone(ctx, chatID, text)
 	case "set_reminder":
-		bs.SetReminder(chatID, text, true, client)
+		bs.SetReminder(ctx, chatID, text, true, client)
 	case "unset_reminder":
-		bs.SetReminder(chatID, text, false, client)
+		bs.SetReminder(ctx, chatID, text, false, client)
+	case "search":
+		bs.Search(ctx, chatID, text)
 	}
 }
 
 // доп сложность
-func (bs *BotService) AnalyzeTasks(chatID int64) {
+func (bs *BotService) AnalyzeTasks(ctx context.Context, chatID int64) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
 	pipeline := []bson.M{ // aggregation pipeline
 		{"$match": bson.M{"chat_id": chatID}},
 		{"$group": bson.M{
@@ -759,37 +1295,36 @@ func (bs *BotService) AnalyzeTasks(chatID int64) {
 		{"$sort": bson.M{"_id": 1}},
 	}
 
-	cursor, err := bs.db.Aggregate(context.TODO(), pipeline)
+	cursor, err := bs.db.Aggregate(dbCtx, pipeline)
 	if err != nil {
-		log.Printf("Failed to execute aggregation pipeline: %v", err)
-		bs.SendMessage(chatID, "Не удалось выполнить анализ задач.")
+		slog.ErrorContext(ctx, "Failed to execute aggregation pipeline", "error", err)
+		bs.reply(ctx, chatID, "analyze.failed", nil)
 		return
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(dbCtx)
 
-	var results []bson.M
-	if err := cursor.All(context.TODO(), &results); err != nil {
-		log.Printf("Failed to decode aggregation results: %v", err)
-		bs.SendMessage(chatID, "Не удалось декодировать результаты анализа задач.")
+	var results []struct {
+		Difficulty  int     `bson:"_id"`
+		Count       int     `bson:"count"`
+		AvgDeadline float64 `bson:"avgDeadline"`
+	}
+	if err := cursor.All(dbCtx, &results); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode aggregation results", "error", err)
+		bs.reply(ctx, chatID, "analyze.failed", nil)
 		return
 	}
 
-	message := "Статистика по сложности задач:\n"
+	// tasks created before difficulties existed have none
+	rows := results[:0]
 	for _, result := range results {
-		difficulty := result["_id"]
-		if difficulty == nil {
-			continue
+		if result.Difficulty != 0 {
+			rows = append(rows, result)
 		}
-		count := result["count"]
-		avgDeadline := result["avgDeadline"]
-		message += fmt.Sprintf("Сложность: %v, Количество: %v, Средний дедлайн: %.2f дней\n", difficulty, count, avgDeadline)
 	}
-
-	bs.SendMessage(chatID, message)
+	bs.reply(ctx, chatID, "analyze", rows)
 }
 
-func CreateIndexes(client *mongo.Client, dbName, collectionName string) error {
-	green := color.New(color.FgGreen).SprintFunc()
+func CreateIndexes(ctx context.Context, client *mongo.Client, dbName, collectionName string) error {
 	collection := client.Database(dbName).Collection(collectionName)
 
 	indexModels := []mongo.IndexModel{
@@ -813,44 +1348,24 @@ func CreateIndexes(client *mongo.Client, dbName, collectionName string) error {
 			Keys:    bson.D{{Key: "createdAt", Value: 1}},
 			Options: options.Index().SetName("createdAt"),
 		},
+		{
+			Keys:    bson.D{{Key: "assignees.id", Value: 1}},
+			Options: options.Index().SetName("assignees"),
+		},
+		{
+			// /search; a collection can have one text index only
+			Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "description", Value: "text"}, {Key: "tags", Value: "text"}},
+			Options: options.Index().SetName("chat_id_text").
+				SetDefaultLanguage("russian").
+				SetWeights(bson.D{{Key: "description", Value: 3}, {Key: "tags", Value: 1}}),
+		},
 	}
 
-	context := context.Background()
-	_, err := collection.Indexes().CreateMany(context, indexModels)
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(green("Indexes created successfully!"))
+	slog.InfoContext(ctx, "Indexes created successfully")
 	return nil
 }
-
-func (bs *BotService) ListTasksByDeadline(chatID int64) {
-	options := options.Find().SetSort(bson.D{{Key: "deadline", Value: 1}})
-	cursor, err := bs.db.Find(context.TODO(), bson.M{"chat_id": chatID}, options)
-	if err != nil {
-		log.Printf("Failed to list tasks: %s", err)
-		bs.SendMessage(chatID, "Не удалось получить список задач.")
-		return
-	}
-	defer cursor.Close(context.TODO())
-
-	var tasks []Task
-	if err := cursor.All(context.TODO(), &tasks); err != nil {
-		log.Printf("Failed to decode tasks: %s", err)
-		bs.SendMessage(chatID, "Не удалось получить список задач.")
-		return
-	}
-
-	if len(tasks) == 0 {
-		bs.SendMessage(chatID, "Нет задач для отображения.")
-		return
-	}
-
-	message := "Список задач (сортировка по дате):\n"
-	for _, task := range tasks {
-		message += fmt.Sprintf("- %s (Дедлайн: %s)\n", task.Description, task.Deadline.Format("2006-01-02 15:04"))
-	}
-
-	bs.SendMessage(chatID, message)
-}
@@ -0,0 +1,233 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// icsTime is the UTC form of DATE-TIME in iCalendar, and icsLocalTime the
+// floating form, which calendars show as is in their own time zone.
+const (
+	icsTime      = "20060102T150405Z"
+	icsLocalTime = "20060102T150405"
+)
+
+// icsWriter writes iCalendar content lines: CRLF line ends, and lines folded
+// before 75 octets without splitting a UTF-8 sequence.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (iw *icsWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	s := name + ":" + value
+	var b strings.Builder
+	for limit := 75; len(s) > limit; limit = 74 {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	_, iw.err = io.WriteString(iw.w, b.String())
+}
+
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// writeICS writes the tasks with a deadline as events at the deadline. Tasks with
+// a reminder get an alarm at the deadline, when the bot sends its own reminder.
+func writeICS(w io.Writer, lang string, each func(fn func(Task) error) error) error {
+	name, err := render(lang, "calendar.name", nil)
+	if err != nil {
+		return err
+	}
+
+	iw := &icsWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//Task bot//Tasks//"+strings.ToUpper(lang))
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", "PUBLISH")
+	iw.line("X-WR-CALNAME", icsTextEscaper.Replace(html.UnescapeString(name)))
+	// how often subscribed calendars should fetch the feed again
+	iw.line("REFRESH-INTERVAL;VALUE=DURATION", "PT1H")
+	iw.line("X-PUBLISHED-TTL", "PT1H")
+	if iw.err != nil {
+		return iw.err
+	}
+
+	now := time.Now().UTC().Format(icsTime)
+	err = each(func(t Task) error {
+		if t.Deadline.IsZero() {
+			return nil
+		}
+		summary := t.Description
+		if t.Mark {
+			summary = "✅ " + summary
+		}
+		summary = icsTextEscaper.Replace(summary)
+
+		iw.line("BEGIN", "VEVENT")
+		iw.line("UID", t.ID.Hex()+"@tasks")
+		iw.line("DTSTAMP", now)
+		if !t.CreatedAt.IsZero() {
+			iw.line("CREATED", t.CreatedAt.UTC().Format(icsTime))
+		}
+		// deadlines keep the wall clock in UTC, see /set_deadline
+		iw.line("DTSTART", t.Deadline.UTC().Format(icsLocalTime))
+		iw.line("SUMMARY", summary)
+		iw.line("TRANSP", "TRANSPARENT")
+		if t.ReminderExists && !t.Mark {
+			iw.line("BEGIN", "VALARM")
+			iw.line("ACTION", "DISPLAY")
+			iw.line("DESCRIPTION", summary)
+			iw.line("TRIGGER", "PT0S")
+			iw.line("END", "VALARM")
+		}
+		iw.line("END", "VEVENT")
+		return iw.err
+	})
+	if err != nil {
+		return err
+	}
+	iw.line("END", "VCALENDAR")
+	return iw.err
+}
+
+func calendarTokenKey(token string) string {
+	return "calendar:" + token
+}
+
+func userCalendarKey(userID int64) string {
+	return fmt.Sprintf("user:%d:calendar", userID)
+}
+
+func newCalendarToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (bs *BotService) calendarURL(token string) string {
+	return strings.TrimSuffix(bs.opts.CalendarURL, "/") + "/calendar/" + token + ".ics"
+}
+
+// CalendarLink handles /calendar and /calendar reset in a private chat. The link
+// carries a secret token that anyone holding it can read the feed with, so reset
+// replaces it with a new one.
+func (bs *BotService) CalendarLink(ctx context.Context, chatID int64, text string) {
+	if bs.opts.CalendarURL == "" {
+		bs.reply(ctx, chatID, "calendar.disabled", nil)
+		return
+	}
+	if chatID < 0 {
+		bs.reply(ctx, chatID, "calendar.private_only", nil)
+		return
+	}
+	reset := strings.EqualFold(strings.TrimSpace(text), "reset")
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	token, err := bs.rdb.Get(redisCtx, userCalendarKey(chatID)).Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(ctx, "Failed to get calendar token", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	if token == "" || reset {
+		newToken, err := newCalendarToken()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to generate calendar token", "error", err)
+			bs.reply(ctx, chatID, "error.later", nil)
+			return
+		}
+		pipe := bs.rdb.TxPipeline()
+		if token != "" {
+			pipe.Del(redisCtx, calendarTokenKey(token))
+		}
+		pipe.Set(redisCtx, calendarTokenKey(newToken), chatID, 0)
+		pipe.Set(redisCtx, userCalendarKey(chatID), newToken, 0)
+		if _, err := pipe.Exec(redisCtx); err != nil {
+			slog.ErrorContext(ctx, "Failed to save calendar token", "error", err)
+			bs.reply(ctx, chatID, "error.later", nil)
+			return
+		}
+		token = newToken
+	}
+	bs.reply(ctx, chatID, "calendar.link", view{"URL": bs.calendarURL(token), "Reset": reset})
+}
+
+// CalendarHandler serves /calendar/<token>.ics: the user's own tasks and the
+// group tasks assigned to them, for calendar apps to subscribe to.
+func (bs *BotService) CalendarHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/"), ".ics")
+		if !ok || token == "" || strings.Contains(token, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		redisCtx, cancel := bs.redisContext(ctx)
+		value, err := bs.rdb.Get(redisCtx, calendarTokenKey(token)).Result()
+		cancel()
+		if err == redis.Nil {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Failed to get calendar token", "error", err)
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		userID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		filter := bson.M{
+			"$or":      bson.A{bson.M{"chat_id": userID}, bson.M{"assignees.id": userID}},
+			"deadline": bson.M{"$gt": time.Time{}},
+		}
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, max-age=300")
+		w.Header().Set("Content-Disposition", `inline; filename="tasks.ics"`)
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		feedCtx, cancel := context.WithTimeout(ctx, exportTimeout)
+		defer cancel()
+		lang := bs.language(feedCtx, userID)
+		err = writeICS(w, lang, func(fn func(Task) error) error {
+			return bs.eachTask(feedCtx, filter, fn)
+		})
+		if err != nil {
+			// the status is already sent, the client sees a truncated file
+			slog.ErrorContext(ctx, "Failed to write calendar feed", "user_id", userID, "error", err)
+		}
+	})
+}
@@ -0,0 +1,310 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportTimeout bounds reading the tasks and uploading the file. Exports of large
+// lists take much longer than a single storage call.
+const exportTimeout = 5 * time.Minute
+
+// exportFormat writes tasks in one file format. each calls fn for every task of
+// the list in the order of /list.
+type exportFormat struct {
+	ext string
+	// deadlineOnly leaves out tasks without a deadline.
+	deadlineOnly bool
+	write        func(w io.Writer, lang string, each func(fn func(Task) error) error) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"json": {ext: "json", write: writeJSON},
+	"csv":  {ext: "csv", write: writeCSV},
+	"md":   {ext: "md", write: writeMarkdown},
+	"ics":  {ext: "ics", deadlineOnly: true, write: writeICS},
+}
+
+// exportTask is a task as it appears in JSON exports. Times are omitted rather
+// than given as year 1. The deadline has no offset, see exportDeadline.
+type exportTask struct {
+	Description     string     `json:"description"`
+	Done            bool       `json:"done"`
+	Difficulty      int        `json:"difficulty,omitempty"`
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+	Deadline        string     `json:"deadline,omitempty"`
+	Reminder        bool       `json:"reminder"`
+	Tags            []string   `json:"tags,omitempty"`
+	CreatedBy       int64      `json:"created_by,omitempty"`
+	CreatedByName   string     `json:"created_by_name,omitempty"`
+	Assignees       []Assignee `json:"assignees,omitempty"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	CompletedBy     int64      `json:"completed_by,omitempty"`
+	CompletedByName string     `json:"completed_by_name,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func writeJSON(w io.Writer, _ string, each func(fn func(Task) error) error) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("  ", "  ")
+	sep := "\n  "
+	err := each(func(t Task) error {
+		buf.Reset()
+		err := enc.Encode(exportTask{
+			Description:     t.Description,
+			Done:            t.Mark,
+			Difficulty:      t.Difficulty,
+			CreatedAt:       optionalTime(t.CreatedAt),
+			Deadline:        exportDeadline(t.Deadline),
+			Reminder:        t.ReminderExists,
+			Tags:            t.Tags,
+			CreatedBy:       t.CreatedBy,
+			CreatedByName:   t.CreatedByName,
+			Assignees:       t.Assignees,
+			CompletedAt:     optionalTime(t.CompletedAt),
+			CompletedBy:     t.CompletedBy,
+			CompletedByName: t.CompletedByName,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		sep = ",\n  "
+		_, err = w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+var csvHeader = []string{
+	"description", "done", "difficulty", "created_at", "deadline", "reminder",
+	"created_by", "created_by_name", "assignees", "completed_at", "completed_by", "completed_by_name",
+	"tags",
+}
+
+func writeCSV(w io.Writer, _ string, each func(fn func(Task) error) error) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	err := each(func(t Task) error {
+		names := make([]string, len(t.Assignees))
+		for i, a := range t.Assignees {
+			names[i] = a.Name
+		}
+		return cw.Write([]string{
+			csvCell(t.Description),
+			strconv.FormatBool(t.Mark),
+			strconv.Itoa(t.Difficulty),
+			csvTime(t.CreatedAt),
+			exportDeadline(t.Deadline),
+			strconv.FormatBool(t.ReminderExists),
+			csvID(t.CreatedBy),
+			csvCell(t.CreatedByName),
+			csvCell(strings.Join(names, "; ")),
+			csvTime(t.CompletedAt),
+			csvID(t.CompletedBy),
+			csvCell(t.CompletedByName),
+			csvCell(strings.Join(t.Tags, " ")),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell keeps spreadsheets from running user text as a formula.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// exportDeadline writes a deadline as the wall clock it is, without an offset,
+// the way import reads a time that has none. With the Z of UTC it would be
+// moved by the offset of the bot's time zone on the way back in.
+func exportDeadline(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+func csvID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// writeMarkdown writes a checklist, with the words from the catalog of lang.
+func writeMarkdown(w io.Writer, lang string, each func(fn func(Task) error) error) error {
+	title, err := render(lang, "export.md_title", nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, title+"\n\n"); err != nil {
+		return err
+	}
+	return each(func(t Task) error {
+		t.Description = markdownEscaper.Replace(t.Description)
+		line, err := render(lang, "export.md_task", t)
+		if err != nil {
+			return err
+		}
+		// the catalog escapes for Telegram HTML, the file is plain text
+		_, err = io.WriteString(w, html.UnescapeString(line)+"\n")
+		return err
+	})
+}
+
+// markdownEscaper keeps descriptions from turning into Markdown markup.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`, "#", `\#`,
+)
+
+// cursorFile is a document that is written from a Mongo cursor while it is being
+// uploaded, so the file never has to fit in memory. Every upload, including the
+// retries of the outbox, reads the tasks again.
+type cursorFile struct {
+	ctx   context.Context
+	name  string
+	write func(w io.Writer) error
+}
+
+func (f cursorFile) NeedsUpload() bool { return true }
+
+func (f cursorFile) SendData() string { return "" }
+
+func (f cursorFile) UploadData() (string, io.Reader, error) {
+	pr, pw := io.Pipe()
+	// the upload may give up without closing the reader, do not block the writer forever
+	context.AfterFunc(f.ctx, func() { pr.CloseWithError(f.ctx.Err()) })
+	go func() {
+		pw.CloseWithError(f.write(pw))
+	}()
+	return f.name, pr, nil
+}
+
+// ExportTasks handles /export json|csv|md and sends the tasks of the chat as a document.
+func (bs *BotService) ExportTasks(ctx context.Context, chatID int64, text string) {
+	name := strings.ToLower(strings.TrimSpace(text))
+	format, ok := exportFormats[name]
+	if !ok {
+		bs.reply(ctx, chatID, "export.usage", nil)
+		return
+	}
+
+	filter := bson.M{"chat_id": chatID}
+	if format.deadlineOnly {
+		filter["deadline"] = bson.M{"$gt": time.Time{}}
+	}
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	count, err := bs.db.CountDocuments(dbCtx, filter)
+	cancel()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to count tasks", "error", err)
+		bs.reply(ctx, chatID, "export.failed", nil)
+		return
+	}
+	if count == 0 && format.deadlineOnly {
+		bs.reply(ctx, chatID, "export.no_deadlines", nil)
+		return
+	} else if count == 0 {
+		bs.reply(ctx, chatID, "list.empty", nil)
+		return
+	}
+
+	lang := bs.language(ctx, chatID)
+	caption, err := render(lang, "export.caption", view{"Count": int(count)})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "export.caption", "error", err)
+		return
+	}
+
+	exportCtx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	file := cursorFile{
+		ctx:  exportCtx,
+		name: fmt.Sprintf("tasks-%s.%s", time.Now().In(bs.opts.Location).Format("2006-01-02"), format.ext),
+		write: func(w io.Writer) error {
+			return format.write(w, lang, func(fn func(Task) error) error {
+				return bs.eachTask(exportCtx, filter, fn)
+			})
+		},
+	}
+	doc := tgbotapi.NewDocument(chatID, file)
+	doc.Caption = caption
+	doc.ParseMode = tgbotapi.ModeHTML
+	if o, ok := originFrom(ctx); ok && o.Group && o.ChatID == chatID {
+		doc.ReplyToMessageID = o.MessageID
+		doc.AllowSendingWithoutReply = true
+	}
+	if err := bs.send(exportCtx, chatID, doc); err != nil {
+		bs.reply(ctx, chatID, "export.failed", nil)
+	}
+}
+
+// eachTask calls fn for every task matching filter in the order of /list, reading
+// them from a cursor one batch at a time.
+func (bs *BotService) eachTask(ctx context.Context, filter bson.M, fn func(Task) error) error {
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetBatchSize(200)
+	cursor, err := bs.db.Find(ctx, filter, findOptions)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var task Task
+		if err := cursor.Decode(&task); err != nil {
+			return err
+		}
+		if err := fn(task); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,164 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// origin is the message an update came from. It travels in ctx so that tasks can
+// record who created them and replies in groups can quote the message they answer.
+type origin struct {
+	ChatID    int64
+	MessageID int
+	From      *tgbotapi.User
+	Group     bool
+}
+
+type originKey struct{}
+
+func withOrigin(ctx context.Context, message *tgbotapi.Message) context.Context {
+	return context.WithValue(ctx, originKey{}, origin{
+		ChatID:    message.Chat.ID,
+		MessageID: message.MessageID,
+		From:      message.From,
+		Group:     message.Chat.IsGroup() || message.Chat.IsSuperGroup(),
+	})
+}
+
+// withCallbackOrigin is withOrigin for a button press: the member who pressed it,
+// in the chat of the message with the button.
+func withCallbackOrigin(ctx context.Context, query *tgbotapi.CallbackQuery) context.Context {
+	return context.WithValue(ctx, originKey{}, origin{
+		ChatID:    query.Message.Chat.ID,
+		MessageID: query.Message.MessageID,
+		From:      query.From,
+		Group:     query.Message.Chat.IsGroup() || query.Message.Chat.IsSuperGroup(),
+	})
+}
+
+func originFrom(ctx context.Context) (origin, bool) {
+	o, ok := ctx.Value(originKey{}).(origin)
+	return o, ok
+}
+
+// displayName is how a member is shown in listings of a group.
+func displayName(user *tgbotapi.User) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if name == "" {
+		name = user.UserName
+	}
+	return name
+}
+
+// userURL links to a Telegram user. html/template drops URLs with schemes it does
+// not know, so tg: links have to be marked safe.
+func userURL(userID int64) template.URL {
+	return template.URL(fmt.Sprintf("tg://user?id=%d", userID))
+}
+
+// ignoreInGroup reports whether a group message is not meant for the bot: a
+// command addressed to another bot, or chatter that does not reply to the bot.
+// With privacy mode on Telegram filters most of these already.
+func (bs *BotService) ignoreInGroup(message *tgbotapi.Message) bool {
+	if !message.Chat.IsGroup() && !message.Chat.IsSuperGroup() {
+		return false
+	}
+	if message.IsCommand() {
+		_, bot, addressed := strings.Cut(message.CommandWithAt(), "@")
+		return addressed && !strings.EqualFold(bot, bs.api.Self.UserName)
+	}
+	reply := message.ReplyToMessage
+	return reply == nil || reply.From == nil || reply.From.ID != bs.api.Self.ID
+}
+
+// addedToGroup reports whether message announces that the bot joined a group.
+func (bs *BotService) addedToGroup(message *tgbotapi.Message) bool {
+	for _, member := range message.NewChatMembers {
+		if member.ID == bs.api.Self.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// commandStateKey keeps the state of a multi-step command per member in groups,
+// so two members typing at once do not answer each other's prompts.
+func commandStateKey(ctx context.Context, chatID int64) string {
+	if o, ok := originFrom(ctx); ok && o.Group && o.From != nil {
+		return fmt.Sprintf("chat:%d:user:%d:command", chatID, o.From.ID)
+	}
+	return fmt.Sprintf("user:%d:command", chatID)
+}
+
+func reminderModeKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:reminders", chatID)
+}
+
+// SetReminderMode handles /reminders group|private in a group.
+func (bs *BotService) SetReminderMode(ctx context.Context, chatID int64, text string) {
+	if o, ok := originFrom(ctx); !ok || !o.Group {
+		bs.reply(ctx, chatID, "group_only", nil)
+		return
+	}
+
+	mode := strings.ToLower(strings.TrimSpace(text))
+	if mode != "group" && mode != "private" {
+		bs.reply(ctx, chatID, "reminders.usage", nil)
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	if err := bs.rdb.Set(redisCtx, reminderModeKey(chatID), mode, 0).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to save reminder mode", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	bs.reply(ctx, chatID, "reminders."+mode, nil)
+}
+
+func (bs *BotService) privateReminders(ctx context.Context, chatID int64) bool {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	mode, err := bs.rdb.Get(redisCtx, reminderModeKey(chatID)).Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(ctx, "Failed to get reminder mode", "error", err)
+	}
+	return mode == "private"
+}
+
+// remind sends the reminder template name about task. Tasks with assignees are
+// reminded to each of them privately. Otherwise, in a group that asked for private
+// reminders it goes to the member who created the task. Whoever never opened a
+// private chat with the bot is reminded in the group instead.
+func (bs *BotService) remind(ctx context.Context, task Task, name string) error {
+	if task.ChatID < 0 && len(task.Assignees) > 0 {
+		delivered := true
+		for _, a := range task.Assignees {
+			if err := bs.reply(ctx, a.ID, name, task); err != nil {
+				slog.WarnContext(ctx, "Private reminder failed, sending it to the group", "user_id", a.ID, "error", err)
+				delivered = false
+			}
+		}
+		if delivered {
+			return nil
+		}
+		return bs.reply(ctx, task.ChatID, name, task)
+	}
+	if task.ChatID < 0 && task.CreatedBy != 0 && bs.privateReminders(ctx, task.ChatID) {
+		err := bs.reply(ctx, task.CreatedBy, name, task)
+		if err == nil {
+			return nil
+		}
+		slog.WarnContext(ctx, "Private reminder failed, sending it to the group", "user_id", task.CreatedBy, "error", err)
+	}
+	return bs.reply(ctx, task.ChatID, name, task)
+}
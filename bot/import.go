@@ -0,0 +1,827 @@
+package bot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Import limits. Telegram lets bots download files of up to 20 MB, a task list
+// is far smaller than that.
+const (
+	maxImportSize = 2 << 20
+	maxImportRows = 1000
+)
+
+// Reasons an import row is skipped or failed. The message catalogs word them,
+// see import.reason.
+const (
+	reasonEmpty         = "empty"
+	reasonTooLong       = "too_long"
+	reasonBadDate       = "bad_date"
+	reasonDuplicateFile = "duplicate_file"
+	reasonExists        = "exists"
+	reasonArchived      = "archived"
+	reasonNotTask       = "not_task"
+	reasonTooMany       = "too_many"
+	reasonLimit         = "limit"
+	reasonFailed        = "failed"
+)
+
+// importStatus is what happened, or will happen, to an import row.
+type importStatus string
+
+const (
+	importPending  importStatus = "pending"
+	importImported importStatus = "imported"
+	importSkipped  importStatus = "skipped"
+	importFailed   importStatus = "failed"
+)
+
+// importRow is one task of an uploaded file. N is its position in the file, a
+// line for CSV and an item for the other formats, so users can find it there.
+type importRow struct {
+	N      int          `json:"n"`
+	Task   Task         `json:"task"`
+	Status importStatus `json:"status"`
+	Reason string       `json:"reason,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+	// Before and After are the text around Detail in a line of /add, to point
+	// at the token that could not be read.
+	Before string `json:"-"`
+	After  string `json:"-"`
+}
+
+func (r *importRow) fail(reason, detail string) {
+	r.Status, r.Reason, r.Detail = importFailed, reason, detail
+}
+
+func (r *importRow) skip(reason string) {
+	r.Status, r.Reason = importSkipped, reason
+}
+
+// parseImport detects the format of an uploaded file from its name and content
+// and reads the tasks in it. Rows that cannot become a task are returned failed
+// or skipped with the reason, the file as a whole only fails when it is not in a
+// known format. loc is the bot's time zone, deadlines become its wall clock.
+func parseImport(name string, data []byte, loc *time.Location) (format string, rows []importRow, err error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	trimmed := bytes.TrimSpace(data)
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case ext == ".ics" || bytes.HasPrefix(trimmed, []byte("BEGIN:VCALENDAR")):
+		rows, err = parseICS(data, loc)
+		return "ics", rows, err
+	case ext == ".json" || bytes.HasPrefix(trimmed, []byte("[")) || bytes.HasPrefix(trimmed, []byte("{")):
+		return parseImportJSON(trimmed, loc)
+	case ext == ".csv" || ext == ".txt" || ext == "":
+		return parseImportCSV(data, loc)
+	}
+	return "", nil, errors.New("unknown file format")
+}
+
+// importLayouts are the date formats without a zone accepted in JSON and CSV
+// files: our exports, Todoist's floating dates and what people type. Trello and
+// Todoist also write RFC 3339 times, which parseImportTime reads first.
+var importLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"02.01.2006 15:04",
+	"02.01.2006",
+}
+
+// parseImportTime reads a deadline. A time with a zone or an offset is a moment,
+// it becomes the wall clock of loc at that moment. A time without one already is
+// a wall clock and is kept as it is.
+func parseImportTime(s string, loc *time.Location) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return wallClock(t.In(loc)), true
+	}
+	for _, layout := range importLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func truthy(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "y", "x", "done", "completed", "да":
+		return true
+	}
+	return false
+}
+
+// newImportRow builds row n from the fields every format has in some form.
+func newImportRow(n int, description, deadline string, done bool, loc *time.Location) importRow {
+	row := importRow{N: n, Status: importPending}
+	row.Task.Description = strings.Join(strings.Fields(description), " ")
+	row.Task.Mark = done
+	if row.Task.Description == "" {
+		row.fail(reasonEmpty, "")
+		return row
+	}
+	if deadline = strings.TrimSpace(deadline); deadline != "" {
+		t, ok := parseImportTime(deadline, loc)
+		if !ok {
+			row.fail(reasonBadDate, deadline)
+			return row
+		}
+		row.Task.Deadline = t
+	}
+	return row
+}
+
+func setDifficulty(row *importRow, difficulty int) {
+	if difficulty >= 1 && difficulty <= 5 {
+		row.Task.Difficulty = difficulty
+	}
+}
+
+// setTags gives the task of row the tags, with or without a leading #.
+func setTags(row *importRow, tags []string) {
+	for _, tag := range tags {
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "#"); tag != "" {
+			row.Task.Tags = appendTag(row.Task.Tags, tag)
+		}
+	}
+}
+
+// csvColumns maps the headers of known CSV files to task fields: our own export,
+// Todoist's TYPE,CONTENT,...,DATE and spreadsheets people make by hand.
+var csvColumns = map[string]string{
+	"description": "description", "content": "description", "title": "description",
+	"name": "description", "task": "description", "summary": "description",
+	"задача": "description", "описание": "description",
+	"deadline": "deadline", "due": "deadline", "due date": "deadline", "date": "deadline",
+	"дедлайн": "deadline", "срок": "deadline",
+	"done": "done", "completed": "done", "checked": "done", "status": "done",
+	"difficulty": "difficulty", "сложность": "difficulty",
+	"reminder": "reminder",
+	"type":     "type",
+	"tags":     "tags", "теги": "tags", "labels": "tags",
+}
+
+func parseImportCSV(data []byte, loc *time.Location) (string, []importRow, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	if first, _, _ := bufio.NewReader(bytes.NewReader(data)).ReadLine(); bytes.Count(first, []byte(";")) > bytes.Count(first, []byte(",")) {
+		// spreadsheets in Russian locales save with semicolons
+		r.Comma = ';'
+	}
+
+	header, err := r.Read()
+	if err != nil {
+		return "", nil, fmt.Errorf("read CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, h := range header {
+		if field, ok := csvColumns[strings.ToLower(strings.TrimSpace(h))]; ok {
+			if _, seen := columns[field]; !seen {
+				columns[field] = i
+			}
+		}
+	}
+	if _, ok := columns["description"]; !ok {
+		return "", nil, errors.New("no task description column in the CSV header")
+	}
+	format := "csv"
+	if _, ok := columns["type"]; ok {
+		format = "todoist"
+	}
+	get := func(record []string, field string) string {
+		if i, ok := columns[field]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	var rows []importRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				row := importRow{N: parseErr.StartLine}
+				row.fail(reasonFailed, parseErr.Err.Error())
+				rows = append(rows, row)
+				continue
+			}
+			return "", nil, err
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if t := strings.ToLower(get(record, "type")); t != "" && t != "task" {
+			// Todoist puts sections and notes in the same file
+			row := importRow{N: line}
+			row.skip(reasonNotTask)
+			rows = append(rows, row)
+			continue
+		}
+		row := newImportRow(line, csvDescription(get(record, "description")), get(record, "deadline"), truthy(get(record, "done")), loc)
+		row.Task.ReminderExists = truthy(get(record, "reminder"))
+		if d, err := strconv.Atoi(strings.TrimSpace(get(record, "difficulty"))); err == nil {
+			setDifficulty(&row, d)
+		}
+		setTags(&row, strings.FieldsFunc(get(record, "tags"), func(r rune) bool {
+			return r == ' ' || r == ',' || r == ';'
+		}))
+		rows = append(rows, row)
+	}
+	return format, rows, nil
+}
+
+// csvDescription undoes csvCell of our own exports.
+func csvDescription(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// trelloBoard is the part of a Trello board export the import reads.
+type trelloBoard struct {
+	Cards []struct {
+		Name        string `json:"name"`
+		Due         string `json:"due"`
+		DueComplete bool   `json:"dueComplete"`
+		Closed      bool   `json:"closed"`
+	} `json:"cards"`
+}
+
+// todoistBackup is the part of a Todoist JSON backup the import reads.
+type todoistBackup struct {
+	Items []struct {
+		Content string          `json:"content"`
+		Checked json.RawMessage `json:"checked"`
+		Deleted json.RawMessage `json:"is_deleted"`
+		Due     *struct {
+			Date string `json:"date"`
+		} `json:"due"`
+	} `json:"items"`
+}
+
+func parseImportJSON(data []byte, loc *time.Location) (string, []importRow, error) {
+	if bytes.HasPrefix(data, []byte("[")) {
+		var tasks []struct {
+			Description string   `json:"description"`
+			Done        bool     `json:"done"`
+			Difficulty  int      `json:"difficulty"`
+			Deadline    string   `json:"deadline"`
+			Reminder    bool     `json:"reminder"`
+			Tags        []string `json:"tags"`
+		}
+		if err := json.Unmarshal(data, &tasks); err != nil {
+			return "", nil, fmt.Errorf("read JSON: %w", err)
+		}
+		rows := make([]importRow, len(tasks))
+		for i, t := range tasks {
+			rows[i] = newImportRow(i+1, t.Description, t.Deadline, t.Done, loc)
+			rows[i].Task.ReminderExists = t.Reminder
+			setDifficulty(&rows[i], t.Difficulty)
+			setTags(&rows[i], t.Tags)
+		}
+		return "json", rows, nil
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return "", nil, fmt.Errorf("read JSON: %w", err)
+	}
+	switch {
+	case probe["cards"] != nil:
+		var board trelloBoard
+		if err := json.Unmarshal(data, &board); err != nil {
+			return "", nil, fmt.Errorf("read Trello board: %w", err)
+		}
+		rows := make([]importRow, len(board.Cards))
+		for i, c := range board.Cards {
+			rows[i] = newImportRow(i+1, c.Name, c.Due, c.DueComplete, loc)
+			if c.Closed && rows[i].Status == importPending {
+				rows[i].skip(reasonArchived)
+			}
+		}
+		return "trello", rows, nil
+	case probe["items"] != nil:
+		var backup todoistBackup
+		if err := json.Unmarshal(data, &backup); err != nil {
+			return "", nil, fmt.Errorf("read Todoist backup: %w", err)
+		}
+		rows := make([]importRow, len(backup.Items))
+		for i, item := range backup.Items {
+			var due string
+			if item.Due != nil {
+				due = item.Due.Date
+			}
+			rows[i] = newImportRow(i+1, item.Content, due, truthy(strings.Trim(string(item.Checked), `"`)), loc)
+			if truthy(strings.Trim(string(item.Deleted), `"`)) && rows[i].Status == importPending {
+				rows[i].skip(reasonArchived)
+			}
+		}
+		return "todoist", rows, nil
+	}
+	return "", nil, errors.New("unknown JSON layout")
+}
+
+// icsProperty is one content line of an iCalendar file: NAME;PARAMS:VALUE.
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// icsLines unfolds the content lines of an iCalendar file.
+func icsLines(data []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func parseICSProperty(line string) icsProperty {
+	head, value, _ := strings.Cut(line, ":")
+	parts := strings.Split(head, ";")
+	p := icsProperty{name: strings.ToUpper(parts[0]), params: make(map[string]string), value: value}
+	for _, param := range parts[1:] {
+		k, v, _ := strings.Cut(param, "=")
+		p.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return p
+}
+
+var icsTextUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// parseICSTime reads DUE or DTSTART the way parseImportTime reads other files:
+// a UTC time or one with a TZID becomes the wall clock of loc, a floating time
+// or a date is kept as it is.
+func parseICSTime(p icsProperty, loc *time.Location) (time.Time, bool) {
+	if t, err := time.Parse(icsTime, p.value); err == nil {
+		return wallClock(t.In(loc)), true
+	}
+	if tzid := p.params["TZID"]; tzid != "" {
+		if zone, err := time.LoadLocation(tzid); err == nil {
+			if t, err := time.ParseInLocation(icsLocalTime, p.value, zone); err == nil {
+				return wallClock(t.In(loc)), true
+			}
+		}
+	}
+	for _, layout := range []string{icsLocalTime, "20060102"} {
+		if t, err := time.Parse(layout, p.value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseICS reads every VEVENT and VTODO. The deadline is DUE, or DTSTART when
+// there is none, and an alarm turns the reminder on.
+func parseICS(data []byte, loc *time.Location) ([]importRow, error) {
+	var rows []importRow
+	var (
+		in       bool
+		row      importRow
+		deadline icsProperty
+		depth    int
+	)
+	for _, line := range icsLines(data) {
+		if line == "" {
+			continue
+		}
+		p := parseICSProperty(line)
+		switch {
+		case p.name == "BEGIN" && (p.value == "VEVENT" || p.value == "VTODO") && !in:
+			in, depth = true, 0
+			row = importRow{N: len(rows) + 1, Status: importPending}
+			deadline = icsProperty{}
+		case !in:
+		case p.name == "BEGIN":
+			depth++
+			if p.value == "VALARM" {
+				row.Task.ReminderExists = true
+			}
+		case p.name == "END" && depth > 0:
+			depth--
+		case p.name == "END":
+			in = false
+			desc := row.Task.Description
+			r := newImportRow(row.N, desc, "", row.Task.Mark, loc)
+			r.Task.ReminderExists = row.Task.ReminderExists
+			if r.Status == importPending && deadline.value != "" {
+				t, ok := parseICSTime(deadline, loc)
+				if !ok {
+					r.fail(reasonBadDate, deadline.value)
+				}
+				r.Task.Deadline = t
+			}
+			rows = append(rows, r)
+		case depth > 0:
+		case p.name == "SUMMARY":
+			row.Task.Description = icsTextUnescaper.Replace(p.value)
+		case p.name == "DUE":
+			deadline = p
+		case p.name == "DTSTART" && deadline.name != "DUE":
+			deadline = p
+		case p.name == "STATUS" && strings.EqualFold(p.value, "COMPLETED"), p.name == "COMPLETED":
+			row.Task.Mark = true
+		}
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no events or to-dos in the calendar")
+	}
+	return rows, nil
+}
+
+// importTTL is how long a previewed import waits for the member to confirm it.
+const importTTL = 15 * time.Minute
+
+// importReportRows is the longest report sent as a message, longer ones are
+// attached as a CSV file.
+const importReportRows = 50
+
+func importKey(chatID, userID int64) string {
+	return fmt.Sprintf("chat:%d:user:%d:import", chatID, userID)
+}
+
+// importSummary counts the rows of an import by status.
+type importSummary struct {
+	Pending, Imported, Skipped, Failed int
+}
+
+func summarize(rows []importRow) importSummary {
+	var s importSummary
+	for _, row := range rows {
+		switch row.Status {
+		case importPending:
+			s.Pending++
+		case importImported:
+			s.Imported++
+		case importSkipped:
+			s.Skipped++
+		case importFailed:
+			s.Failed++
+		}
+	}
+	return s
+}
+
+// downloadFile fetches a file sent to the bot, failing once it is longer than limit.
+func (bs *BotService) downloadFile(ctx context.Context, fileID string, limit int64) ([]byte, error) {
+	file, err := bs.api.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, file.Link(bs.api.Token), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// the URL holds the bot token, keep it out of the logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("download file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download file: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("download file: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("download file: longer than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// ImportFile handles a document sent to the bot: it reads the tasks in it and
+// shows what importing them would do, with buttons to go ahead or cancel.
+func (bs *BotService) ImportFile(ctx context.Context, chatID int64, doc *tgbotapi.Document) {
+	o, ok := originFrom(ctx)
+	if !ok || o.From == nil {
+		return
+	}
+	if _, ok := bs.authorize(ctx, chatID, actionAdd, nil); !ok {
+		return
+	}
+	if doc.FileSize > maxImportSize {
+		bs.reply(ctx, chatID, "import.too_big", view{"Max": maxImportSize >> 20})
+		return
+	}
+
+	data, err := bs.downloadFile(ctx, doc.FileID, maxImportSize)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to download import file", "error", err)
+		bs.reply(ctx, chatID, "import.download_failed", nil)
+		return
+	}
+	format, rows, err := parseImport(doc.FileName, data, bs.opts.Location)
+	if err != nil {
+		slog.InfoContext(ctx, "Import file not understood", "file", doc.FileName, "error", err)
+		bs.reply(ctx, chatID, "import.unknown_format", nil)
+		return
+	}
+	if err := bs.checkNewRows(ctx, chatID, rows); err != nil {
+		slog.ErrorContext(ctx, "Failed to check import rows", "error", err)
+		bs.reply(ctx, chatID, "import.failed", nil)
+		return
+	}
+
+	summary := summarize(rows)
+	if summary.Pending == 0 {
+		bs.reportImport(ctx, chatID, rows)
+		return
+	}
+
+	payload, err := json.Marshal(rows)
+	if err == nil {
+		redisCtx, cancel := bs.redisContext(ctx)
+		err = bs.rdb.Set(redisCtx, importKey(chatID, o.From.ID), payload, importTTL).Err()
+		cancel()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save import", "error", err)
+		bs.reply(ctx, chatID, "import.failed", nil)
+		return
+	}
+
+	var sample []string
+	for _, row := range rows {
+		if row.Status == importPending && len(sample) < 5 {
+			sample = append(sample, truncate(row.Task.Description, 100))
+		}
+	}
+	lang := bs.language(ctx, chatID)
+	text, err := render(lang, "import.preview", view{
+		"File": doc.FileName, "Format": format, "Total": len(rows), "Summary": summary, "Sample": sample,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "import.preview", "error", err)
+		return
+	}
+	yes, err := render(lang, "import.confirm", view{"N": summary.Pending})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "import.confirm", "error", err)
+		return
+	}
+	no, err := render(lang, "import.cancel", nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "import.cancel", "error", err)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(yes, "import:yes"),
+		tgbotapi.NewInlineKeyboardButtonData(no, "import:no"),
+	))
+	if o.Group {
+		msg.ReplyToMessageID = o.MessageID
+		msg.AllowSendingWithoutReply = true
+	}
+	bs.send(ctx, chatID, msg)
+}
+
+// checkNewRows marks the rows of an import or a bulk /add that cannot be added:
+// too many, too long, repeated or already in the list.
+func (bs *BotService) checkNewRows(ctx context.Context, chatID int64, rows []importRow) error {
+	seen := make(map[string]bool)
+	var descriptions []string
+	for i := range rows {
+		row := &rows[i]
+		if row.Status != importPending {
+			continue
+		}
+		switch {
+		case i >= maxImportRows:
+			row.skip(reasonTooMany)
+		case bs.opts.Limits.MaxDescriptionLength > 0 && utf8.RuneCountInString(row.Task.Description) > bs.opts.Limits.MaxDescriptionLength:
+			row.fail(reasonTooLong, "")
+		case seen[row.Task.Description]:
+			row.skip(reasonDuplicateFile)
+		default:
+			seen[row.Task.Description] = true
+			descriptions = append(descriptions, row.Task.Description)
+		}
+	}
+	if len(descriptions) == 0 {
+		return nil
+	}
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	findOptions := options.Find().SetProjection(bson.M{"description": 1})
+	cursor, err := bs.db.Find(dbCtx, bson.M{"chat_id": chatID, "description": bson.M{"$in": descriptions}}, findOptions)
+	if err != nil {
+		return err
+	}
+	var existing []Task
+	if err := cursor.All(dbCtx, &existing); err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, task := range existing {
+		exists[task.Description] = true
+	}
+	for i := range rows {
+		if rows[i].Status == importPending && exists[rows[i].Task.Description] {
+			rows[i].skip(reasonExists)
+		}
+	}
+	return nil
+}
+
+// ConfirmImport handles the buttons under an import preview.
+func (bs *BotService) ConfirmImport(ctx context.Context, message *tgbotapi.Message, confirmed bool) {
+	chatID := message.Chat.ID
+	o, ok := originFrom(ctx)
+	if !ok || o.From == nil {
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	payload, err := bs.rdb.GetDel(redisCtx, importKey(chatID, o.From.ID)).Bytes()
+	cancel()
+	if err == redis.Nil {
+		// expired, already handled, or pressed by someone else than the uploader
+		bs.reply(ctx, chatID, "import.expired", nil)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to get import", "error", err)
+		bs.reply(ctx, chatID, "import.failed", nil)
+		return
+	}
+	var rows []importRow
+	if err := json.Unmarshal(payload, &rows); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode import", "error", err)
+		bs.reply(ctx, chatID, "import.failed", nil)
+		return
+	}
+
+	bs.send(ctx, chatID, tgbotapi.NewEditMessageReplyMarkup(chatID, message.MessageID,
+		tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+	if !confirmed {
+		bs.reply(ctx, chatID, "import.cancelled", nil)
+		return
+	}
+	if _, ok := bs.authorize(ctx, chatID, actionAdd, nil); !ok {
+		return
+	}
+
+	if err := bs.insertRows(ctx, chatID, o.From, rows); err != nil {
+		slog.ErrorContext(ctx, "Failed to import tasks", "error", err)
+		bs.reply(ctx, chatID, "import.failed", nil)
+		return
+	}
+	bs.reportImport(ctx, chatID, rows)
+}
+
+// insertRows adds the pending rows to the list with one InsertMany and records
+// the outcome of each. Rows that hit the chat_id_description index, added since
+// checkNewRows, are skipped as existing.
+func (bs *BotService) insertRows(ctx context.Context, chatID int64, from *tgbotapi.User, rows []importRow) error {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	room := len(rows)
+	if max := bs.opts.Limits.MaxTasks; max > 0 {
+		count, err := bs.db.CountDocuments(dbCtx, bson.M{"chat_id": chatID})
+		if err != nil {
+			return err
+		}
+		room = max - int(count)
+	}
+
+	now := time.Now()
+	var docs []any
+	var index []int // row of each document
+	for i := range rows {
+		row := &rows[i]
+		if row.Status != importPending {
+			continue
+		}
+		if len(docs) >= room {
+			row.skip(reasonLimit)
+			continue
+		}
+		// known before the insert, so the task can be offered a deadline picker
+		row.Task.ID = primitive.NewObjectID()
+		task := row.Task
+		task.ChatID = chatID
+		task.CreatedAt = now
+		if from != nil {
+			task.CreatedBy = from.ID
+			task.CreatedByName = displayName(from)
+		}
+		if task.Mark {
+			task.ReminderExists = false
+		}
+		docs = append(docs, task)
+		index = append(index, i)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	_, err := bs.db.InsertMany(dbCtx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bulkErr) {
+		return err
+	}
+	markInserted(ctx, rows, index, bulkErr.WriteErrors)
+	return nil
+}
+
+// markInserted records what InsertMany did with the pending rows. index is the
+// row of each document, writeErrors are the documents that were not inserted. A
+// duplicate key is a task that is already in the list.
+func markInserted(ctx context.Context, rows []importRow, index []int, writeErrors []mongo.BulkWriteError) {
+	for _, we := range writeErrors {
+		row := &rows[index[we.Index]]
+		if mongo.IsDuplicateKeyError(we) {
+			row.skip(reasonExists)
+		} else {
+			row.fail(reasonFailed, "")
+			slog.WarnContext(ctx, "Failed to import row", "row", row.N, "error", we)
+		}
+	}
+	for _, i := range index {
+		if rows[i].Status == importPending {
+			rows[i].Status = importImported
+		}
+	}
+}
+
+// reportImport tells what happened to every row, in the message itself for short
+// files and as an attached CSV for long ones.
+func (bs *BotService) reportImport(ctx context.Context, chatID int64, rows []importRow) {
+	summary := summarize(rows)
+	if len(rows) <= importReportRows {
+		bs.reply(ctx, chatID, "import.report", view{"Summary": summary, "Rows": rows})
+		return
+	}
+	bs.reply(ctx, chatID, "import.report", view{"Summary": summary})
+
+	lang := bs.language(ctx, chatID)
+	var b bytes.Buffer
+	cw := csv.NewWriter(&b)
+	cw.Write([]string{"row", "status", "reason", "description"})
+	for _, row := range rows {
+		var reason string
+		if row.Reason != "" {
+			text, err := render(lang, "import.reason", row)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to render message", "template", "import.reason", "error", err)
+				return
+			}
+			reason = html.UnescapeString(text)
+		}
+		cw.Write([]string{strconv.Itoa(row.N), string(row.Status), reason, csvCell(row.Task.Description)})
+	}
+	cw.Flush()
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: "import-report.csv", Bytes: b.Bytes()})
+	bs.send(ctx, chatID, doc)
+}
@@ -0,0 +1,337 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// importZone is the bot's time zone in the import tests.
+var importZone = time.FixedZone("MSK", 3*60*60)
+
+func TestParseImportTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		// Trello
+		{"2026-10-21T15:00:00.000Z", wall(2026, 10, 21, 18, 0), true},
+		{"2026-10-21T15:00:00+01:00", wall(2026, 10, 21, 17, 0), true},
+		// our exports and Todoist's floating dates
+		{"2026-10-21T15:00:00", wall(2026, 10, 21, 15, 0), true},
+		{" 2026-10-21 15:04 ", wall(2026, 10, 21, 15, 4), true},
+		{"2026-10-21", wall(2026, 10, 21, 0, 0), true},
+		{"21.10.2026 09:30", wall(2026, 10, 21, 9, 30), true},
+		{"tomorrow", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseImportTime(tt.s, importZone)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseImportTime(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseICSTime(t *testing.T) {
+	tests := []struct {
+		line string
+		want time.Time
+		ok   bool
+	}{
+		{"DUE:20261021T150000Z", wall(2026, 10, 21, 18, 0), true},
+		// Berlin is two hours ahead of UTC in October
+		{"DUE;TZID=Europe/Berlin:20261021T150000", wall(2026, 10, 21, 16, 0), true},
+		{`DUE;TZID="Europe/Berlin":20261021T150000`, wall(2026, 10, 21, 16, 0), true},
+		{"DUE:20261021T150000", wall(2026, 10, 21, 15, 0), true},
+		{"DUE;VALUE=DATE:20261021", wall(2026, 10, 21, 0, 0), true},
+		{"DUE;TZID=Nowhere/City:20261021T150000", wall(2026, 10, 21, 15, 0), true},
+		{"DUE:soon", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseICSTime(parseICSProperty(tt.line), importZone)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseICSTime(%q) = %v, %v, want %v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// wantRow is the part of an importRow the tests compare.
+type wantRow struct {
+	n          int
+	desc       string
+	deadline   time.Time
+	done       bool
+	difficulty int
+	reminder   bool
+	tags       []string
+	status     importStatus
+	reason     string
+	detail     string
+}
+
+func pending(n int, desc string) wantRow {
+	return wantRow{n: n, desc: desc, status: importPending}
+}
+
+func (w wantRow) due(t time.Time) wantRow     { w.deadline = t; return w }
+func (w wantRow) isDone() wantRow             { w.done = true; return w }
+func (w wantRow) withReminder() wantRow       { w.reminder = true; return w }
+func (w wantRow) hard(difficulty int) wantRow { w.difficulty = difficulty; return w }
+func (w wantRow) tagged(tags ...string) wantRow {
+	w.tags = tags
+	return w
+}
+func (w wantRow) skipped(reason string) wantRow {
+	w.status, w.reason = importSkipped, reason
+	return w
+}
+
+func failed(n int, desc, reason, detail string) wantRow {
+	return wantRow{n: n, desc: desc, status: importFailed, reason: reason, detail: detail}
+}
+
+func compareRows(t *testing.T, name string, got []importRow, want []wantRow) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: %d rows, want %d: %+v", name, len(got), len(want), got)
+		return
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.N != w.n || g.Task.Description != w.desc || !g.Task.Deadline.Equal(w.deadline) ||
+			g.Task.Mark != w.done || g.Task.Difficulty != w.difficulty || g.Task.ReminderExists != w.reminder ||
+			!slices.Equal(g.Task.Tags, w.tags) || g.Status != w.status || g.Reason != w.reason || g.Detail != w.detail {
+			t.Errorf("%s: row %d = %d %q deadline %v done %v difficulty %d reminder %v tags %q %s %s %q,\nwant %d %q deadline %v done %v difficulty %d reminder %v tags %q %s %s %q",
+				name, i, g.N, g.Task.Description, g.Task.Deadline, g.Task.Mark, g.Task.Difficulty, g.Task.ReminderExists, g.Task.Tags, g.Status, g.Reason, g.Detail,
+				w.n, w.desc, w.deadline, w.done, w.difficulty, w.reminder, w.tags, w.status, w.reason, w.detail)
+		}
+	}
+}
+
+func TestParseImport(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		data   string
+		format string
+		rows   []wantRow
+	}{
+		{
+			name: "json",
+			file: "tasks.json",
+			data: `[
+				{"description": "Write  report", "difficulty": 3, "deadline": "2026-10-21T15:00:00", "reminder": true, "tags": ["#Work", "work"]},
+				{"description": " ", "done": true},
+				{"description": "Old", "done": true, "deadline": "2026-10-21T15:00:00Z", "difficulty": 9},
+				{"description": "Later", "deadline": "someday"}
+			]`,
+			format: "json",
+			rows: []wantRow{
+				pending(1, "Write report").due(wall(2026, 10, 21, 15, 0)).hard(3).withReminder().tagged("work"),
+				failed(2, "", reasonEmpty, "").isDone(),
+				pending(3, "Old").due(wall(2026, 10, 21, 18, 0)).isDone(),
+				failed(4, "Later", reasonBadDate, "someday"),
+			},
+		},
+		{
+			name: "csv with semicolons",
+			file: "Задачи.csv",
+			data: "Задача;Срок;Сложность;Теги;Done\n" +
+				"Купить молоко;21.10.2026 09:30;2;дом, покупки;нет\n" +
+				"'=SUM(A1);;9;;да\n" +
+				"\n" +
+				"\"Позвонить; маме\";2026-10-21T12:00:00+03:00;;;\n",
+			format: "csv",
+			rows: []wantRow{
+				pending(2, "Купить молоко").due(wall(2026, 10, 21, 9, 30)).hard(2).tagged("дом", "покупки"),
+				pending(3, "=SUM(A1)").isDone(),
+				pending(5, "Позвонить; маме").due(wall(2026, 10, 21, 12, 0)),
+			},
+		},
+		{
+			name:   "csv without a known description",
+			file:   "tasks.csv",
+			data:   "what,when\nx,y\n",
+			format: "",
+		},
+		{
+			name: "todoist csv",
+			file: "Inbox.csv",
+			data: "TYPE,CONTENT,PRIORITY,DATE\n" +
+				"task,Pay rent,4,2026-10-21\n" +
+				"section,Home,,\n" +
+				"task,Call the bank,1,2026-10-22 10:00\n",
+			format: "todoist",
+			rows: []wantRow{
+				pending(2, "Pay rent").due(wall(2026, 10, 21, 0, 0)),
+				{n: 3, status: importSkipped, reason: reasonNotTask},
+				pending(4, "Call the bank").due(wall(2026, 10, 22, 10, 0)),
+			},
+		},
+		{
+			name: "todoist json",
+			file: "backup.json",
+			data: `{"items": [
+				{"content": "Pay rent", "checked": 0, "is_deleted": 0, "due": {"date": "2026-10-21T15:00:00"}},
+				{"content": "Old", "checked": true, "is_deleted": 1, "due": null},
+				{"content": "Call", "checked": "1", "due": {"date": "2026-10-21T12:00:00Z"}}
+			]}`,
+			format: "todoist",
+			rows: []wantRow{
+				pending(1, "Pay rent").due(wall(2026, 10, 21, 15, 0)),
+				pending(2, "Old").isDone().skipped(reasonArchived),
+				pending(3, "Call").due(wall(2026, 10, 21, 15, 0)).isDone(),
+			},
+		},
+		{
+			name: "trello",
+			file: "board.json",
+			data: `{"name": "Board", "cards": [
+				{"name": "Design", "due": "2026-10-21T15:00:00.000Z", "dueComplete": false, "closed": false},
+				{"name": "Ship", "due": "2026-10-22T09:30:00.000Z", "dueComplete": true},
+				{"name": "Old card", "due": null, "closed": true}
+			]}`,
+			format: "trello",
+			rows: []wantRow{
+				pending(1, "Design").due(wall(2026, 10, 21, 18, 0)),
+				pending(2, "Ship").due(wall(2026, 10, 22, 12, 30)).isDone(),
+				pending(3, "Old card").skipped(reasonArchived),
+			},
+		},
+		{
+			name: "ics",
+			file: "calendar.ics",
+			data: "BEGIN:VCALENDAR\r\n" +
+				"VERSION:2.0\r\n" +
+				"BEGIN:VTODO\r\n" +
+				"SUMMARY:Call Anna\\, Bob\\; and the\r\n" +
+				"  long report\r\n" +
+				"DUE:20261021T150000Z\r\n" +
+				"DTSTART:20261020T090000Z\r\n" +
+				"BEGIN:VALARM\r\n" +
+				"SUMMARY:Not a task\r\n" +
+				"END:VALARM\r\n" +
+				"END:VTODO\r\n" +
+				"BEGIN:VEVENT\r\n" +
+				"SUMMARY:Line one\\nLine two\r\n" +
+				"DTSTART;TZID=Europe/Berlin:20261021T150000\r\n" +
+				"STATUS:COMPLETED\r\n" +
+				"END:VEVENT\r\n" +
+				"BEGIN:VEVENT\r\n" +
+				"SUMMARY:Party\r\n" +
+				"DTSTART:20261024T190000\r\n" +
+				"END:VEVENT\r\n" +
+				"BEGIN:VEVENT\r\n" +
+				"SUMMARY:Someday\r\n" +
+				"DTSTART:later\r\n" +
+				"END:VEVENT\r\n" +
+				"END:VCALENDAR\r\n",
+			format: "ics",
+			rows: []wantRow{
+				pending(1, "Call Anna, Bob; and the long report").due(wall(2026, 10, 21, 18, 0)).withReminder(),
+				pending(2, "Line one Line two").due(wall(2026, 10, 21, 16, 0)).isDone(),
+				pending(3, "Party").due(wall(2026, 10, 24, 19, 0)),
+				failed(4, "Someday", reasonBadDate, "later"),
+			},
+		},
+		{
+			name:   "unknown",
+			file:   "notes.pdf",
+			data:   "%PDF-1.4",
+			format: "",
+		},
+	}
+	for _, tt := range tests {
+		format, rows, err := parseImport(tt.file, []byte(tt.data), importZone)
+		if tt.format == "" {
+			if err == nil {
+				t.Errorf("%s: parseImport read it as %s, want an error", tt.name, format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseImport: %v", tt.name, err)
+			continue
+		}
+		if format != tt.format {
+			t.Errorf("%s: format %q, want %q", tt.name, format, tt.format)
+		}
+		compareRows(t, tt.name, rows, tt.rows)
+	}
+}
+
+// Our own exports must come back with the deadlines they were written with.
+func TestExportImportRoundTrip(t *testing.T) {
+	tasks := []Task{
+		{Description: "Write report", Deadline: wall(2026, 10, 21, 15, 0), Difficulty: 3, ReminderExists: true, Tags: []string{"work"}},
+		{Description: "=1+1", Mark: true, CreatedAt: time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)},
+	}
+	want := []wantRow{
+		pending(1, "Write report").due(wall(2026, 10, 21, 15, 0)).hard(3).withReminder().tagged("work"),
+		pending(2, "=1+1").isDone(),
+	}
+	each := func(fn func(Task) error) error {
+		for _, task := range tasks {
+			if err := fn(task); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range []string{"json", "csv"} {
+		var buf bytes.Buffer
+		if err := exportFormats[name].write(&buf, "en", each); err != nil {
+			t.Fatalf("%s export: %v", name, err)
+		}
+		if strings.Contains(buf.String(), "2026-10-21T15:00:00Z") {
+			t.Errorf("%s export gives the deadline in UTC:\n%s", name, buf.String())
+		}
+		_, rows, err := parseImport("tasks."+name, buf.Bytes(), importZone)
+		if err != nil {
+			t.Fatalf("%s import: %v", name, err)
+		}
+		// CSV rows are numbered by line, after the header
+		if name == "csv" {
+			for i := range rows {
+				rows[i].N--
+			}
+		}
+		compareRows(t, name, rows, want)
+	}
+}
+
+func TestMarkInserted(t *testing.T) {
+	rows := []importRow{
+		{N: 1, Status: importPending},
+		{N: 2, Status: importFailed, Reason: reasonBadDate},
+		{N: 3, Status: importPending},
+		{N: 4, Status: importPending},
+	}
+	index := []int{0, 2, 3}
+	writeErrors := []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 1, Code: 11000, Message: "E11000 duplicate key error"}},
+		{WriteError: mongo.WriteError{Index: 2, Code: 121, Message: "Document failed validation"}},
+	}
+	markInserted(context.Background(), rows, index, writeErrors)
+
+	want := []struct {
+		status importStatus
+		reason string
+	}{
+		{importImported, ""},
+		{importFailed, reasonBadDate},
+		{importSkipped, reasonExists},
+		{importFailed, reasonFailed},
+	}
+	for i, w := range want {
+		if rows[i].Status != w.status || rows[i].Reason != w.reason {
+			t.Errorf("row %d = %s %s, want %s %s", rows[i].N, rows[i].Status, rows[i].Reason, w.status, w.reason)
+		}
+	}
+}
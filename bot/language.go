@@ -0,0 +1,121 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+type languageKey struct{}
+
+func withLanguage(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, languageKey{}, lang)
+}
+
+// matchLanguage maps a Telegram language code such as "en-US" to a catalog, or
+// returns "" when there is none for it.
+func matchLanguage(code string) string {
+	base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(code)), "-")
+	if _, ok := catalogs[base]; ok {
+		return base
+	}
+	return ""
+}
+
+func userLanguageKey(userID int64) string {
+	return fmt.Sprintf("user:%d:language", userID)
+}
+
+func chatLanguageKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:language", chatID)
+}
+
+// resolveLanguage picks the language to answer userID in: their /language choice,
+// then the language of their Telegram client, then the default. The result is
+// remembered for chatID, so reminders sent later use it too.
+func (bs *BotService) resolveLanguage(ctx context.Context, chatID, userID int64, code string) string {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	lang := ""
+	if userID != 0 {
+		chosen, err := bs.rdb.Get(redisCtx, userLanguageKey(userID)).Result()
+		if err != nil && err != redis.Nil {
+			slog.ErrorContext(ctx, "Failed to get user language", "error", err)
+		}
+		lang = matchLanguage(chosen)
+	}
+	if lang == "" {
+		lang = matchLanguage(code)
+	}
+	if lang == "" {
+		lang = bs.opts.DefaultLanguage
+	}
+
+	if err := bs.rdb.Set(redisCtx, chatLanguageKey(chatID), lang, 0).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to save chat language", "error", err)
+	}
+	return lang
+}
+
+// language returns the language of replies to chatID: the one resolved for the
+// update being handled, else the one last used in the chat.
+func (bs *BotService) language(ctx context.Context, chatID int64) string {
+	if lang, ok := ctx.Value(languageKey{}).(string); ok {
+		return lang
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	lang, err := bs.rdb.Get(redisCtx, chatLanguageKey(chatID)).Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(ctx, "Failed to get chat language", "error", err)
+	}
+	if lang = matchLanguage(lang); lang == "" {
+		lang = bs.opts.DefaultLanguage
+	}
+	return lang
+}
+
+// SetLanguage handles /language [code|auto]. Without an argument it shows the
+// current language and the choices.
+func (bs *BotService) SetLanguage(ctx context.Context, chatID, userID int64, languageCode, text string) {
+	arg := strings.ToLower(strings.TrimSpace(text))
+	if arg == "" {
+		bs.reply(ctx, chatID, "language.current", view{"Language": bs.language(ctx, chatID), "Languages": Languages()})
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	if arg == "auto" {
+		if err := bs.rdb.Del(redisCtx, userLanguageKey(userID)).Err(); err != nil {
+			slog.ErrorContext(ctx, "Failed to reset user language", "error", err)
+			bs.reply(ctx, chatID, "error.later", nil)
+			return
+		}
+		ctx = withLanguage(ctx, bs.resolveLanguage(ctx, chatID, userID, languageCode))
+		bs.reply(ctx, chatID, "language.auto", nil)
+		return
+	}
+
+	lang := matchLanguage(arg)
+	if lang == "" {
+		bs.reply(ctx, chatID, "language.unknown", view{"Languages": Languages()})
+		return
+	}
+	if err := bs.rdb.Set(redisCtx, userLanguageKey(userID), lang, 0).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to save user language", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	if err := bs.rdb.Set(redisCtx, chatLanguageKey(chatID), lang, 0).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to save chat language", "error", err)
+	}
+	bs.reply(withLanguage(ctx, lang), chatID, "language.set", nil)
+}
@@ -0,0 +1,242 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// Limits protects the bot from users flooding it with commands.
+type Limits struct {
+	// Requests per Window allowed for each command class.
+	Read   int
+	Write  int
+	Other  int
+	Window time.Duration
+	// Strikes is how many throttled windows within BanDuration lead to a temporary ban.
+	Strikes     int
+	BanDuration time.Duration
+	// MaxTasks caps the tasks stored per chat, MaxDescriptionLength caps a description in characters.
+	MaxTasks             int
+	MaxDescriptionLength int
+	// Admins are never throttled and may use /ban and /unban.
+	Admins map[int64]bool
+}
+
+type commandClass string
+
+const (
+	classRead  commandClass = "read"
+	classWrite commandClass = "write"
+	classOther commandClass = "other"
+)
+
+func classify(command string) commandClass {
+	switch command {
+	case "list", "list_by_deadline", "stats", "analyze", "my", "team_stats", "export", "search",
+		"view", "today", "tomorrow", "week", "overdue":
+		return classRead
+	case "add", "edit", "delete", "set_deadline", "is_done", "set_reminder", "unset_reminder",
+		"assign", "unassign", "import", "pick":
+		return classWrite
+	}
+	return classOther
+}
+
+// limitedCommand is the command message counts against. A document is an
+// import, and a message without a command is the next step of the command
+// waiting for its arguments.
+func (bs *BotService) limitedCommand(ctx context.Context, message *tgbotapi.Message) string {
+	if command := message.Command(); command != "" {
+		return command
+	}
+	if message.Document != nil {
+		return "import"
+	}
+	state, err := bs.GetCommandState(ctx, message.Chat.ID)
+	if err != nil {
+		return ""
+	}
+	return state
+}
+
+func (l Limits) limitFor(class commandClass) int {
+	switch class {
+	case classRead:
+		return l.Read
+	case classWrite:
+		return l.Write
+	}
+	return l.Other
+}
+
+func (bs *BotService) isAdmin(userID int64) bool {
+	return bs.opts.Limits.Admins[userID]
+}
+
+// allowCommand reports whether userID may run command now and tells the user when
+// they are banned or throttled. Redis errors let the command through.
+func (bs *BotService) allowCommand(ctx context.Context, chatID, userID int64, command string) bool {
+	limits := bs.opts.Limits
+	if userID == 0 || bs.isAdmin(userID) || limits.Window <= 0 {
+		return true
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	banTTL, err := bs.rdb.TTL(redisCtx, banKey(userID)).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check ban", "error", err)
+		return true
+	}
+	if banTTL > 0 {
+		bs.notifyOnce(redisCtx, ctx, chatID, userID, "banned", banTTL, "throttle.banned")
+		return false
+	}
+
+	class := classify(command)
+	limit := limits.limitFor(class)
+	if limit <= 0 {
+		return true
+	}
+
+	window := time.Now().UnixNano() / int64(limits.Window)
+	key := fmt.Sprintf("ratelimit:%s:%d:%d", class, userID, window)
+	pipe := bs.rdb.TxPipeline()
+	incr := pipe.Incr(redisCtx, key)
+	pipe.Expire(redisCtx, key, limits.Window)
+	if _, err := pipe.Exec(redisCtx); err != nil {
+		slog.ErrorContext(ctx, "Failed to count request", "error", err)
+		return true
+	}
+	if incr.Val() <= int64(limit) {
+		return true
+	}
+
+	slog.WarnContext(ctx, "User throttled", "user_id", userID, "class", class)
+	if incr.Val() == int64(limit)+1 {
+		bs.addStrike(redisCtx, ctx, userID)
+	}
+	wait := time.Duration((window+1)*int64(limits.Window) - time.Now().UnixNano())
+	bs.notifyOnce(redisCtx, ctx, chatID, userID, string(class), wait, "throttle.slow")
+	return false
+}
+
+// addStrike counts one throttled window and bans the user after too many.
+func (bs *BotService) addStrike(redisCtx, ctx context.Context, userID int64) {
+	limits := bs.opts.Limits
+	if limits.Strikes <= 0 || limits.BanDuration <= 0 {
+		return
+	}
+	key := fmt.Sprintf("ratelimit:strikes:%d", userID)
+	strikes, err := bs.rdb.Incr(redisCtx, key).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to count strike", "error", err)
+		return
+	}
+	if strikes == 1 {
+		bs.rdb.Expire(redisCtx, key, limits.BanDuration)
+	}
+	if strikes >= int64(limits.Strikes) {
+		if err := bs.rdb.Set(redisCtx, banKey(userID), "auto", limits.BanDuration).Err(); err != nil {
+			slog.ErrorContext(ctx, "Failed to ban user", "error", err)
+			return
+		}
+		bs.rdb.Del(redisCtx, key)
+		slog.WarnContext(ctx, "User banned automatically", "user_id", userID, "duration", limits.BanDuration)
+	}
+}
+
+// notifyOnce replies at most once per ttl, so throttled users cannot make the bot spam.
+func (bs *BotService) notifyOnce(redisCtx, ctx context.Context, chatID, userID int64, reason string, ttl time.Duration, name string) {
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	key := fmt.Sprintf("ratelimit:notified:%s:%d", reason, userID)
+	first, err := bs.rdb.SetNX(redisCtx, key, 1, ttl).Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(ctx, "Failed to record throttle notice", "error", err)
+		return
+	}
+	if first {
+		bs.reply(ctx, chatID, name, view{"Wait": ttl})
+	}
+}
+
+func banKey(userID int64) string {
+	return fmt.Sprintf("ban:%d", userID)
+}
+
+// BanUser handles /ban <user_id> [duration].
+func (bs *BotService) BanUser(ctx context.Context, chatID, adminID int64, text string) {
+	if !bs.isAdmin(adminID) {
+		bs.reply(ctx, chatID, "admin_only", nil)
+		return
+	}
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 || len(fields) > 2 {
+		bs.reply(ctx, chatID, "ban.usage", nil)
+		return
+	}
+	userID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		bs.reply(ctx, chatID, "ban.bad_id", nil)
+		return
+	}
+	duration := bs.opts.Limits.BanDuration
+	if len(fields) == 2 {
+		duration, err = time.ParseDuration(fields[1])
+		if err != nil || duration <= 0 {
+			bs.reply(ctx, chatID, "ban.bad_duration", nil)
+			return
+		}
+	}
+	if bs.isAdmin(userID) {
+		bs.reply(ctx, chatID, "ban.admin", nil)
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	if err := bs.rdb.Set(redisCtx, banKey(userID), fmt.Sprintf("admin:%d", adminID), duration).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to ban user", "error", err)
+		bs.reply(ctx, chatID, "ban.failed", nil)
+		return
+	}
+	slog.InfoContext(ctx, "User banned by admin", "user_id", userID, "admin_id", adminID, "duration", duration)
+	bs.reply(ctx, chatID, "ban.done", view{"UserID": userID, "Duration": duration})
+}
+
+// UnbanUser handles /unban <user_id> and also clears the user's strikes.
+func (bs *BotService) UnbanUser(ctx context.Context, chatID, adminID int64, text string) {
+	if !bs.isAdmin(adminID) {
+		bs.reply(ctx, chatID, "admin_only", nil)
+		return
+	}
+
+	userID, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	if err != nil {
+		bs.reply(ctx, chatID, "unban.usage", nil)
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	if err := bs.rdb.Del(redisCtx, banKey(userID), fmt.Sprintf("ratelimit:strikes:%d", userID)).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to unban user", "error", err)
+		bs.reply(ctx, chatID, "unban.failed", nil)
+		return
+	}
+	slog.InfoContext(ctx, "User unbanned by admin", "user_id", userID, "admin_id", adminID)
+	bs.reply(ctx, chatID, "unban.done", view{"UserID": userID})
+}
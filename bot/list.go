@@ -0,0 +1,253 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// listKey identifies a listing in the callback data of its page buttons: "c"
+// for /list, "d" for /list_by_deadline, and "q" followed by the token of the
+// query for a filtered /list.
+type listKey string
+
+const (
+	listCreated  listKey = "c"
+	listDeadline listKey = "d"
+)
+
+// listLineOverhead is the room a listing line needs besides the description:
+// number, deadline, mark and time left.
+const listLineOverhead = 80
+
+// lineMarkup is the room task_line needs for the tags of task and, in a group,
+// the links to its author and assignees, as the message splitter counts it.
+func lineMarkup(task Task, group bool) int {
+	n := 0
+	for _, tag := range task.Tags {
+		n += len(" #") + escapedLength(tag)
+	}
+	if !group {
+		return n
+	}
+	if task.CreatedBy != 0 {
+		n += textLength(" 👤 ") + userLinkLength(task.CreatedBy, task.CreatedByName)
+	}
+	for i, a := range task.Assignees {
+		if i == 0 {
+			n += textLength(" 👉 ")
+		} else {
+			n += len(", ")
+		}
+		n += userLinkLength(a.ID, a.Name)
+	}
+	return n
+}
+
+func userLinkLength(userID int64, name string) int {
+	return textLength(`<a href="`+string(userURL(userID))+`"></a>`) + escapedLength(name)
+}
+
+// ListTasks handles /list, with an optional query (see parseListQuery) or the
+// name of a saved view.
+func (bs *BotService) ListTasks(ctx context.Context, chatID int64, text string) {
+	text = strings.Join(strings.Fields(text), " ")
+	if text == "" {
+		bs.sendListPage(ctx, chatID, listCreated, 0)
+		return
+	}
+	text, err := expandView(text, func(name string) (string, error) {
+		return bs.savedView(ctx, chatID, name)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get view", "error", err)
+	}
+	bs.listQuery(ctx, chatID, text)
+}
+
+func (bs *BotService) ListTasksByDeadline(ctx context.Context, chatID int64) {
+	bs.sendListPage(ctx, chatID, listDeadline, 0)
+}
+
+// listQuery sends the first page of the tasks matching the query text. The
+// query is kept in Redis for the page buttons, which cannot carry it.
+func (bs *BotService) listQuery(ctx context.Context, chatID int64, text string) {
+	if _, err := parseListQuery(text, bs.wallNow()); err != nil {
+		bs.reply(ctx, chatID, "list.bad_query", err)
+		return
+	}
+	token := listQueryToken(text)
+	redisCtx, cancel := bs.redisContext(ctx)
+	err := bs.rdb.Set(redisCtx, listQueryKey(chatID, token), text, listQueryTTL).Err()
+	cancel()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save list query", "error", err)
+		bs.reply(ctx, chatID, "list.failed", nil)
+		return
+	}
+	bs.sendListPage(ctx, chatID, listKey("q"+token), 0)
+}
+
+func (bs *BotService) sendListPage(ctx context.Context, chatID int64, key listKey, page int) {
+	text, markup, err := bs.renderListPage(ctx, chatID, key, page)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list tasks", "error", err)
+		bs.reply(ctx, chatID, "list.failed", nil)
+		return
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeHTML
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	bs.send(ctx, chatID, msg)
+}
+
+// editListPage handles a press on a Prev/Next button. data is "list:<key>:<page>".
+func (bs *BotService) editListPage(ctx context.Context, message *tgbotapi.Message, data string) {
+	chatID := message.Chat.ID
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 {
+		slog.WarnContext(ctx, "Malformed list callback", "data", data)
+		return
+	}
+	key := listKey(parts[1])
+	page, err := strconv.Atoi(parts[2])
+	if (key != listCreated && key != listDeadline && !strings.HasPrefix(parts[1], "q")) || err != nil || page < 0 {
+		slog.WarnContext(ctx, "Malformed list callback", "data", data)
+		return
+	}
+
+	text, markup, err := bs.renderListPage(ctx, chatID, key, page)
+	if err == redis.Nil {
+		bs.reply(ctx, chatID, "list.expired", nil)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to list tasks", "error", err)
+		bs.reply(ctx, chatID, "list.failed", nil)
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(chatID, message.MessageID, text)
+	edit.ParseMode = tgbotapi.ModeHTML
+	edit.ReplyMarkup = markup
+	bs.send(ctx, chatID, edit)
+}
+
+// queryFor returns the query of the listing key. It is redis.Nil when the
+// query of a filtered listing has expired.
+func (bs *BotService) queryFor(ctx context.Context, chatID int64, key listKey) (listQuery, error) {
+	switch key {
+	case listCreated:
+		return parseListQuery("", bs.wallNow())
+	case listDeadline:
+		q, err := parseListQuery("sort:deadline", bs.wallNow())
+		q.Text = ""
+		return q, err
+	}
+	redisCtx, cancel := bs.redisContext(ctx)
+	text, err := bs.rdb.Get(redisCtx, listQueryKey(chatID, strings.TrimPrefix(string(key), "q"))).Result()
+	cancel()
+	if err != nil {
+		return listQuery{}, err
+	}
+	return parseListQuery(text, bs.wallNow())
+}
+
+// renderListPage returns the text of one page and its Prev/Next buttons. A page
+// past the end, left behind by deleted tasks, shows the last page instead.
+func (bs *BotService) renderListPage(ctx context.Context, chatID int64, key listKey, page int) (string, *tgbotapi.InlineKeyboardMarkup, error) {
+	q, err := bs.queryFor(ctx, chatID, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	filter := q.mongoFilter(chatID)
+	total, err := bs.db.CountDocuments(dbCtx, filter)
+	if err != nil {
+		return "", nil, err
+	}
+	if total == 0 && q.Text != "" {
+		text, err := render(bs.language(ctx, chatID), "list.no_match", view{"Query": q.Text})
+		return text, nil, err
+	} else if total == 0 {
+		text, err := render(bs.language(ctx, chatID), "list.empty", nil)
+		return text, nil, err
+	}
+
+	pageSize := bs.opts.PageSize
+	pages := int((total + int64(pageSize) - 1) / int64(pageSize))
+	if page >= pages {
+		page = pages - 1
+	}
+
+	findOptions := options.Find().
+		SetSort(q.sort).
+		SetSkip(int64(page * pageSize)).
+		SetLimit(int64(pageSize))
+	cursor, err := bs.db.Find(dbCtx, filter, findOptions)
+	if err != nil {
+		return "", nil, err
+	}
+	defer cursor.Close(dbCtx)
+
+	var tasks []Task
+	if err := cursor.All(dbCtx, &tasks); err != nil {
+		return "", nil, err
+	}
+
+	// keep a full page under the message limit however long the descriptions are
+	share := (maxMessageLength-100)/pageSize - listLineOverhead
+	group := chatID < 0
+
+	items := make([]listItem, len(tasks))
+	for i, task := range tasks {
+		budget := max(share-lineMarkup(task, group), 1)
+		items[i] = listItem{Task: task, N: page*pageSize + i + 1, Description: truncateEscaped(task.Description, budget), Group: group}
+	}
+	bs.rememberShown(ctx, chatID, string(key), items)
+	lang := bs.language(ctx, chatID)
+	text, err := render(lang, "list", view{
+		"Items":      items,
+		"ByDeadline": q.ByDeadline,
+		"Query":      q.Text,
+		"Page":       page + 1,
+		"Pages":      pages,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	markup, err := listKeyboard(lang, key, page, pages)
+	return text, markup, err
+}
+
+func listKeyboard(lang string, key listKey, page, pages int) (*tgbotapi.InlineKeyboardMarkup, error) {
+	var row []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		label, err := render(lang, "list.prev", nil)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("list:%s:%d", key, page-1)))
+	}
+	if page < pages-1 {
+		label, err := render(lang, "list.next", nil)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("list:%s:%d", key, page+1)))
+	}
+	if len(row) == 0 {
+		return nil, nil
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(row)
+	return &markup, nil
+}
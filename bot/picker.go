@@ -0,0 +1,295 @@
+package bot
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The deadline picker is a message whose buttons walk through a month calendar,
+// the hours and the minutes, and a confirmation. Each button carries the whole
+// state as "dl:<task>:<step><value>", where task is the ObjectID in base64 (16
+// characters) and value the time picked so far, so nothing is kept in Redis.
+// The longest, "dl:" + 16 + ":" + "s0601021504", is 31 bytes, well within the
+// 64 Telegram allows.
+const (
+	pickerMonth   = 'm' // value 0601: show the month
+	pickerDay     = 'd' // value 060102: a day is picked, show the hours
+	pickerHour    = 'h' // value 06010215: an hour is picked, show the minutes
+	pickerMinute  = 't' // value 0601021504: the time is picked, ask to confirm
+	pickerConfirm = 's' // value 0601021504: set the deadline
+	pickerCancel  = 'x'
+	pickerNoop    = 'n' // labels and empty cells
+)
+
+// pickerLayouts are the time layouts of the values of each step.
+var pickerLayouts = map[byte]string{
+	pickerMonth:   "0601",
+	pickerDay:     "060102",
+	pickerHour:    "06010215",
+	pickerMinute:  "0601021504",
+	pickerConfirm: "0601021504",
+}
+
+// pickerMinuteStep is the spacing of the minutes offered.
+const pickerMinuteStep = 5
+
+func encodeTaskID(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func decodeTaskID(s string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("bad task id %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func pickerData(task string, step byte, t time.Time) string {
+	data := "dl:" + task + ":" + string(step)
+	if layout, ok := pickerLayouts[step]; ok {
+		data += t.Format(layout)
+	}
+	return data
+}
+
+func pickerButton(label, task string, step byte, t time.Time) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData(label, pickerData(task, step, t))
+}
+
+// pickerToday is the start of today on the wall clock, as deadlines keep it.
+func (bs *BotService) pickerToday() time.Time {
+	now := time.Now().In(bs.opts.Location)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// deadlineButton is the button that opens the picker for task, at the month of
+// its deadline if it has a later one.
+func (bs *BotService) deadlineButton(lang string, task Task) (tgbotapi.InlineKeyboardButton, error) {
+	label, err := render(lang, "picker.open", nil)
+	if err != nil {
+		return tgbotapi.InlineKeyboardButton{}, err
+	}
+	month := bs.pickerToday()
+	if task.Deadline.After(month) {
+		month = task.Deadline
+	}
+	return pickerButton(label, encodeTaskID(task.ID), pickerMonth, month), nil
+}
+
+// showDeadlinePicker sends the picker for task, starting at a month calendar.
+func (bs *BotService) showDeadlinePicker(ctx context.Context, chatID int64, task Task) {
+	lang := bs.language(ctx, chatID)
+	month := bs.pickerToday()
+	if task.Deadline.After(month) {
+		month = task.Deadline
+	}
+	text, markup, err := bs.renderPicker(lang, task, pickerMonth, month)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render deadline picker", "error", err)
+		bs.reply(ctx, chatID, "deadline.failed", nil)
+		return
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = markup
+	if o, ok := originFrom(ctx); ok && o.Group && o.ChatID == chatID {
+		msg.ReplyToMessageID = o.MessageID
+		msg.AllowSendingWithoutReply = true
+	}
+	bs.send(ctx, chatID, msg)
+}
+
+// PickDeadline handles a press on a button of the deadline picker.
+func (bs *BotService) PickDeadline(ctx context.Context, message *tgbotapi.Message, data string) {
+	chatID := message.Chat.ID
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		slog.WarnContext(ctx, "Malformed deadline picker callback", "data", data)
+		return
+	}
+	step, value := parts[2][0], parts[2][1:]
+	if step == pickerNoop {
+		return
+	}
+	if step == pickerCancel {
+		bs.send(ctx, chatID, tgbotapi.NewEditMessageReplyMarkup(chatID, message.MessageID,
+			tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+		return
+	}
+	layout, ok := pickerLayouts[step]
+	if !ok {
+		slog.WarnContext(ctx, "Malformed deadline picker callback", "data", data)
+		return
+	}
+	t, err := time.Parse(layout, value)
+	id, idErr := decodeTaskID(parts[1])
+	if err != nil || idErr != nil {
+		slog.WarnContext(ctx, "Malformed deadline picker callback", "data", data)
+		return
+	}
+
+	var task Task
+	dbCtx, cancel := bs.mongoContext(ctx)
+	err = bs.db.FindOne(dbCtx, bson.M{"_id": id, "chat_id": chatID}).Decode(&task)
+	cancel()
+	if err == mongo.ErrNoDocuments {
+		bs.send(ctx, chatID, tgbotapi.NewEditMessageReplyMarkup(chatID, message.MessageID,
+			tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+		bs.reply(ctx, chatID, "deadline.not_found", nil)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to find task", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+
+	if step == pickerConfirm {
+		bs.send(ctx, chatID, tgbotapi.NewEditMessageReplyMarkup(chatID, message.MessageID,
+			tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+		bs.setTaskDeadline(ctx, chatID, task, t)
+		return
+	}
+
+	text, markup, err := bs.renderPicker(bs.language(ctx, chatID), task, step, t)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render deadline picker", "error", err)
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(chatID, message.MessageID, text)
+	edit.ParseMode = tgbotapi.ModeHTML
+	edit.ReplyMarkup = &markup
+	bs.send(ctx, chatID, edit)
+}
+
+// renderPicker returns the text and the buttons of one step of the picker. t is
+// the time picked so far: a month, a day, an hour or a full deadline.
+func (bs *BotService) renderPicker(lang string, task Task, step byte, t time.Time) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	id := encodeTaskID(task.ID)
+	today := bs.pickerToday()
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	switch step {
+	case pickerMonth:
+		month := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		title, err := render(lang, "picker.month", view{"Month": int(month.Month()), "Year": month.Year()})
+		if err != nil {
+			return "", tgbotapi.InlineKeyboardMarkup{}, err
+		}
+		prev := tgbotapi.NewInlineKeyboardButtonData(" ", pickerData(id, pickerNoop, month))
+		if month.After(today) {
+			prev = pickerButton("‹", id, pickerMonth, month.AddDate(0, -1, 0))
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			prev,
+			pickerButton(title, id, pickerNoop, month),
+			pickerButton("›", id, pickerMonth, month.AddDate(0, 1, 0)),
+		))
+
+		weekdays, err := render(lang, "picker.weekdays", nil)
+		if err != nil {
+			return "", tgbotapi.InlineKeyboardMarkup{}, err
+		}
+		var header []tgbotapi.InlineKeyboardButton
+		for _, name := range strings.Fields(weekdays) {
+			header = append(header, pickerButton(name, id, pickerNoop, month))
+		}
+		rows = append(rows, header)
+
+		// weeks start on Monday; days before today cannot be picked
+		var week []tgbotapi.InlineKeyboardButton
+		for i := 0; i < (int(month.Weekday())+6)%7; i++ {
+			week = append(week, pickerButton(" ", id, pickerNoop, month))
+		}
+		for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+			label := fmt.Sprint(day.Day())
+			if day.Equal(today) {
+				label = "·" + label + "·"
+			}
+			if day.Before(today) {
+				week = append(week, pickerButton(" ", id, pickerNoop, month))
+			} else {
+				week = append(week, pickerButton(label, id, pickerDay, day))
+			}
+			if len(week) == 7 {
+				rows = append(rows, week)
+				week = nil
+			}
+		}
+		if len(week) > 0 {
+			for len(week) < 7 {
+				week = append(week, pickerButton(" ", id, pickerNoop, month))
+			}
+			rows = append(rows, week)
+		}
+
+	case pickerDay:
+		for hour := 0; hour < 24; hour += 6 {
+			var row []tgbotapi.InlineKeyboardButton
+			for h := hour; h < hour+6; h++ {
+				row = append(row, pickerButton(fmt.Sprintf("%02d", h), id, pickerHour, t.Add(time.Duration(h)*time.Hour)))
+			}
+			rows = append(rows, row)
+		}
+		back, err := render(lang, "picker.back", nil)
+		if err != nil {
+			return "", tgbotapi.InlineKeyboardMarkup{}, err
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(pickerButton(back, id, pickerMonth, t)))
+
+	case pickerHour:
+		for minute := 0; minute < 60; minute += 4 * pickerMinuteStep {
+			var row []tgbotapi.InlineKeyboardButton
+			for m := minute; m < minute+4*pickerMinuteStep; m += pickerMinuteStep {
+				row = append(row, pickerButton(fmt.Sprintf("%02d:%02d", t.Hour(), m), id, pickerMinute, t.Add(time.Duration(m)*time.Minute)))
+			}
+			rows = append(rows, row)
+		}
+		back, err := render(lang, "picker.back", nil)
+		if err != nil {
+			return "", tgbotapi.InlineKeyboardMarkup{}, err
+		}
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(pickerButton(back, id, pickerDay, day)))
+
+	case pickerMinute:
+		set, err := render(lang, "picker.set", nil)
+		if err != nil {
+			return "", tgbotapi.InlineKeyboardMarkup{}, err
+		}
+		back, err := render(lang, "picker.back", nil)
+		if err != nil {
+			return "", tgbotapi.InlineKeyboardMarkup{}, err
+		}
+		hour := t.Truncate(time.Hour)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			pickerButton(set, id, pickerConfirm, t),
+			pickerButton(back, id, pickerHour, hour),
+		))
+	}
+
+	cancelLabel, err := render(lang, "picker.cancel", nil)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(pickerButton(cancelLabel, id, pickerCancel, t)))
+
+	text, err := render(lang, "picker", view{
+		"Step":        string(step),
+		"Description": truncate(task.Description, 200),
+		"Time":        t,
+		"Deadline":    task.Deadline,
+	})
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...), err
+}
@@ -0,0 +1,331 @@
+package bot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// listQueryTTL is how long the page buttons of a filtered listing work.
+	listQueryTTL = 7 * 24 * time.Hour
+	// maxViews is the number of views a chat can save.
+	maxViews = 20
+)
+
+// listQuery is what a listing shows: the tasks matching filter, in the order of
+// sort. Text is the query as typed, empty for /list and /list_by_deadline.
+type listQuery struct {
+	Text       string
+	ByDeadline bool
+	filter     bson.A
+	sort       bson.D
+}
+
+// queryError points at the word of a query that could not be read.
+type queryError struct {
+	Token string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("bad query token %q", e.Token)
+}
+
+var (
+	comparison = regexp.MustCompile(`^(difficulty|due)(>=|<=|>|<|=)(.+)$`)
+	compareOps = map[string]string{">=": "$gte", "<=": "$lte", ">": "$gt", "<": "$lt", "=": "$eq"}
+	// sortFields are the names sort: takes and the fields they order by.
+	sortFields = map[string]string{
+		"deadline": "deadline", "difficulty": "difficulty", "created": "_id",
+		"name": "description", "status": "mark",
+	}
+)
+
+// parseListQuery reads the query of /list, made of words such as
+//
+//	status:open    status:done, status:all
+//	difficulty>=3  also >, <, <=, = and difficulty:3
+//	due<7d         deadline within 7 days, or h and w; due>7d is later
+//	overdue        open and past the deadline
+//	tag:work
+//	has:reminder   also has:deadline, has:assignee, has:tags, and no:... for the
+//	               tasks without
+//	sort:deadline,-difficulty  deadline, difficulty, created, name or status,
+//	               descending with -
+//
+// All the conditions must hold. now is the time due and overdue count from,
+// with the wall clock kept in UTC like the deadlines.
+func parseListQuery(text string, now time.Time) (listQuery, error) {
+	q := listQuery{Text: text}
+	for _, word := range strings.Fields(text) {
+		if !q.add(strings.ToLower(word), now) {
+			return q, &queryError{Token: word}
+		}
+	}
+	if len(q.sort) == 0 {
+		q.sort = bson.D{{Key: "_id", Value: 1}}
+	} else if q.sort[len(q.sort)-1].Key != "_id" {
+		// _id breaks ties so a task never shows up on two pages
+		q.sort = append(q.sort, bson.E{Key: "_id", Value: 1})
+	}
+	return q, nil
+}
+
+func (q *listQuery) add(word string, now time.Time) bool {
+	if word == "overdue" {
+		q.filter = append(q.filter, bson.M{"mark": false, "deadline": bson.M{"$gt": time.Time{}, "$lt": now}})
+		return true
+	}
+	if m := comparison.FindStringSubmatch(word); m != nil {
+		return q.compare(m[1], compareOps[m[2]], m[3], now)
+	}
+
+	key, value, ok := strings.Cut(word, ":")
+	if !ok || value == "" {
+		return false
+	}
+	switch key {
+	case "status":
+		switch value {
+		case "open":
+			q.filter = append(q.filter, bson.M{"mark": false})
+		case "done":
+			q.filter = append(q.filter, bson.M{"mark": true})
+		case "all":
+		default:
+			return false
+		}
+	case "difficulty":
+		return q.compare(key, "$eq", value, now)
+	case "tag":
+		q.filter = append(q.filter, bson.M{"tags": strings.TrimPrefix(value, "#")})
+	case "has", "no":
+		has := key == "has"
+		switch value {
+		case "reminder":
+			q.filter = append(q.filter, bson.M{"reminder": has})
+		case "deadline":
+			if has {
+				q.filter = append(q.filter, bson.M{"deadline": bson.M{"$gt": time.Time{}}})
+			} else {
+				q.filter = append(q.filter, bson.M{"deadline": bson.M{"$lte": time.Time{}}})
+			}
+		case "assignee":
+			q.filter = append(q.filter, bson.M{"assignees.0": bson.M{"$exists": has}})
+		case "tags":
+			q.filter = append(q.filter, bson.M{"tags.0": bson.M{"$exists": has}})
+		default:
+			return false
+		}
+	case "sort":
+		q.sort = nil
+		for _, name := range strings.Split(value, ",") {
+			order := 1
+			if rest, desc := strings.CutPrefix(name, "-"); desc {
+				name, order = rest, -1
+			}
+			field, ok := sortFields[name]
+			if !ok || slices.ContainsFunc(q.sort, func(e bson.E) bool { return e.Key == field }) {
+				return false
+			}
+			q.sort = append(q.sort, bson.E{Key: field, Value: order})
+		}
+		q.ByDeadline = q.sort[0].Key == "deadline"
+	default:
+		return false
+	}
+	return true
+}
+
+func (q *listQuery) compare(field, op, value string, now time.Time) bool {
+	switch field {
+	case "difficulty":
+		d, err := strconv.Atoi(value)
+		if err != nil || d < 1 || d > 5 {
+			return false
+		}
+		q.filter = append(q.filter, bson.M{"difficulty": bson.M{op: d}})
+	case "due":
+		d, ok := parsePeriod(value)
+		if !ok || op == "$eq" {
+			return false
+		}
+		q.filter = append(q.filter, bson.M{"deadline": bson.M{"$gt": time.Time{}}},
+			bson.M{"deadline": bson.M{op: now.Add(d)}})
+	default:
+		return false
+	}
+	return true
+}
+
+// parsePeriod reads a period such as 12h, 7d or 2w.
+func parsePeriod(s string) (time.Duration, bool) {
+	units := map[byte]time.Duration{'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if len(s) < 2 {
+		return 0, false
+	}
+	unit, ok := units[s[len(s)-1]]
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if !ok || err != nil || n < 0 || n > 10000 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// mongoFilter is the filter of the query for the tasks of chatID.
+func (q listQuery) mongoFilter(chatID int64) bson.M {
+	filter := bson.M{"chat_id": chatID}
+	if len(q.filter) > 0 {
+		filter["$and"] = q.filter
+	}
+	return filter
+}
+
+// listQueryToken names a query in Redis and in the callback data of its page
+// buttons. The same query always gets the same token.
+func listQueryToken(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:10]
+}
+
+func listQueryKey(chatID int64, token string) string {
+	return fmt.Sprintf("chat:%d:list:%s", chatID, token)
+}
+
+func chatViewsKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:views", chatID)
+}
+
+var viewName = regexp.MustCompile(`^[\p{L}\p{N}_-]{1,32}$`)
+
+// savedView returns the query saved as name, or "" when there is none.
+func (bs *BotService) savedView(ctx context.Context, chatID int64, name string) (string, error) {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	query, err := bs.rdb.HGet(redisCtx, chatViewsKey(chatID), strings.ToLower(name)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return query, err
+}
+
+// expandView returns the query /list runs for text: the query saved as text
+// when text is a single word that names a view, text itself otherwise.
+func expandView(text string, saved func(name string) (string, error)) (string, error) {
+	if strings.ContainsAny(text, " :<>=") {
+		return text, nil
+	}
+	query, err := saved(text)
+	if err != nil || query == "" {
+		return text, err
+	}
+	return query, nil
+}
+
+// SavedViews handles /view: /view lists the saved views, /view <name> shows
+// one, /view save <name> <query> saves a query of /list under a name and
+// /view delete <name> removes it.
+func (bs *BotService) SavedViews(ctx context.Context, chatID int64, text string) {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		bs.listViews(ctx, chatID)
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	switch strings.ToLower(args[0]) {
+	case "save":
+		if len(args) < 3 || !viewName.MatchString(args[1]) {
+			bs.reply(ctx, chatID, "view.usage", nil)
+			return
+		}
+		name := strings.ToLower(args[1])
+		query := strings.Join(args[2:], " ")
+		if _, err := parseListQuery(query, bs.wallNow()); err != nil {
+			bs.reply(ctx, chatID, "list.bad_query", err)
+			return
+		}
+		count, err := bs.rdb.HLen(redisCtx, chatViewsKey(chatID)).Result()
+		if err == nil && count >= maxViews {
+			exists, err := bs.rdb.HExists(redisCtx, chatViewsKey(chatID), name).Result()
+			if err == nil && !exists {
+				bs.reply(ctx, chatID, "view.limit", view{"Max": maxViews})
+				return
+			}
+		}
+		if err == nil {
+			err = bs.rdb.HSet(redisCtx, chatViewsKey(chatID), name, query).Err()
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to save view", "error", err)
+			bs.reply(ctx, chatID, "error.later", nil)
+			return
+		}
+		bs.reply(ctx, chatID, "view.saved", view{"Name": name, "Query": query})
+	case "delete":
+		if len(args) != 2 {
+			bs.reply(ctx, chatID, "view.usage", nil)
+			return
+		}
+		name := strings.ToLower(args[1])
+		removed, err := bs.rdb.HDel(redisCtx, chatViewsKey(chatID), name).Result()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to delete view", "error", err)
+			bs.reply(ctx, chatID, "error.later", nil)
+			return
+		}
+		if removed == 0 {
+			bs.reply(ctx, chatID, "view.not_found", view{"Name": name})
+			return
+		}
+		bs.reply(ctx, chatID, "view.deleted", view{"Name": name})
+	default:
+		if len(args) != 1 {
+			bs.reply(ctx, chatID, "view.usage", nil)
+			return
+		}
+		query, err := bs.savedView(ctx, chatID, args[0])
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get view", "error", err)
+			bs.reply(ctx, chatID, "error.later", nil)
+			return
+		}
+		if query == "" {
+			bs.reply(ctx, chatID, "view.not_found", view{"Name": strings.ToLower(args[0])})
+			return
+		}
+		bs.listQuery(ctx, chatID, query)
+	}
+}
+
+func (bs *BotService) listViews(ctx context.Context, chatID int64) {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	views, err := bs.rdb.HGetAll(redisCtx, chatViewsKey(chatID)).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get views", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	type entry struct{ Name, Query string }
+	entries := make([]entry, 0, len(views))
+	for name, query := range views {
+		entries = append(entries, entry{name, query})
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return strings.Compare(a.Name, b.Name) })
+	bs.reply(ctx, chatID, "view.list", entries)
+}
@@ -0,0 +1,157 @@
+package bot
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseListQuery(t *testing.T) {
+	now := wall(2026, 10, 21, 18, 0)
+	byID := bson.E{Key: "_id", Value: 1}
+	tests := []struct {
+		text       string
+		filter     bson.A
+		sort       bson.D
+		byDeadline bool
+	}{
+		{text: "", sort: bson.D{byID}},
+		{text: "status:open", filter: bson.A{bson.M{"mark": false}}, sort: bson.D{byID}},
+		{text: "STATUS:Done", filter: bson.A{bson.M{"mark": true}}, sort: bson.D{byID}},
+		{text: "status:all", sort: bson.D{byID}},
+		{text: "difficulty>=3", filter: bson.A{bson.M{"difficulty": bson.M{"$gte": 3}}}, sort: bson.D{byID}},
+		{text: "difficulty<2", filter: bson.A{bson.M{"difficulty": bson.M{"$lt": 2}}}, sort: bson.D{byID}},
+		{text: "difficulty:4", filter: bson.A{bson.M{"difficulty": bson.M{"$eq": 4}}}, sort: bson.D{byID}},
+		{
+			text: "due<7d",
+			filter: bson.A{
+				bson.M{"deadline": bson.M{"$gt": time.Time{}}},
+				bson.M{"deadline": bson.M{"$lt": wall(2026, 10, 28, 18, 0)}},
+			},
+			sort: bson.D{byID},
+		},
+		{
+			text: "due>=12h",
+			filter: bson.A{
+				bson.M{"deadline": bson.M{"$gt": time.Time{}}},
+				bson.M{"deadline": bson.M{"$gte": wall(2026, 10, 22, 6, 0)}},
+			},
+			sort: bson.D{byID},
+		},
+		{
+			text:   "overdue",
+			filter: bson.A{bson.M{"mark": false, "deadline": bson.M{"$gt": time.Time{}, "$lt": now}}},
+			sort:   bson.D{byID},
+		},
+		{text: "tag:#Work", filter: bson.A{bson.M{"tags": "work"}}, sort: bson.D{byID}},
+		{
+			text: "has:reminder no:deadline has:assignee no:tags",
+			filter: bson.A{
+				bson.M{"reminder": true},
+				bson.M{"deadline": bson.M{"$lte": time.Time{}}},
+				bson.M{"assignees.0": bson.M{"$exists": true}},
+				bson.M{"tags.0": bson.M{"$exists": false}},
+			},
+			sort: bson.D{byID},
+		},
+		{
+			text:       "sort:deadline,-difficulty",
+			sort:       bson.D{{Key: "deadline", Value: 1}, {Key: "difficulty", Value: -1}, byID},
+			byDeadline: true,
+		},
+		{text: "sort:-created", sort: bson.D{{Key: "_id", Value: -1}}},
+		{text: "sort:name", sort: bson.D{{Key: "description", Value: 1}, byID}},
+		{
+			text:   "status:open sort:status",
+			filter: bson.A{bson.M{"mark": false}},
+			sort:   bson.D{{Key: "mark", Value: 1}, byID},
+		},
+	}
+	for _, tt := range tests {
+		q, err := parseListQuery(tt.text, now)
+		if err != nil {
+			t.Errorf("parseListQuery(%q): %v", tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.filter, tt.filter) {
+			t.Errorf("parseListQuery(%q) filter = %v, want %v", tt.text, q.filter, tt.filter)
+		}
+		if !reflect.DeepEqual(q.sort, tt.sort) {
+			t.Errorf("parseListQuery(%q) sort = %v, want %v", tt.text, q.sort, tt.sort)
+		}
+		if q.ByDeadline != tt.byDeadline {
+			t.Errorf("parseListQuery(%q) ByDeadline = %v, want %v", tt.text, q.ByDeadline, tt.byDeadline)
+		}
+	}
+}
+
+func TestParseListQueryErrors(t *testing.T) {
+	tests := []struct {
+		text  string
+		token string
+	}{
+		{"Report", "Report"},
+		{"status:maybe", "status:maybe"},
+		{"status:open Tag:", "Tag:"},
+		{"difficulty>9", "difficulty>9"},
+		{"difficulty:hard", "difficulty:hard"},
+		{"due=7d", "due=7d"},
+		{"due<7m", "due<7m"},
+		{"due<-1d", "due<-1d"},
+		{"has:everything", "has:everything"},
+		{"sort:size", "sort:size"},
+		{"sort:deadline,-deadline", "sort:deadline,-deadline"},
+	}
+	for _, tt := range tests {
+		_, err := parseListQuery(tt.text, quickAddNow)
+		var qerr *queryError
+		if !errors.As(err, &qerr) || qerr.Token != tt.token {
+			t.Errorf("parseListQuery(%q) = %v, want a bad token %q", tt.text, err, tt.token)
+		}
+	}
+}
+
+func TestMongoFilter(t *testing.T) {
+	q, err := parseListQuery("status:open", quickAddNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"chat_id": int64(7), "$and": bson.A{bson.M{"mark": false}}}
+	if got := q.mongoFilter(7); !reflect.DeepEqual(got, want) {
+		t.Errorf("mongoFilter = %v, want %v", got, want)
+	}
+	q, _ = parseListQuery("", quickAddNow)
+	if got, want := q.mongoFilter(7), (bson.M{"chat_id": int64(7)}); !reflect.DeepEqual(got, want) {
+		t.Errorf("mongoFilter = %v, want %v", got, want)
+	}
+}
+
+func TestExpandView(t *testing.T) {
+	views := map[string]string{"work": "tag:work status:open"}
+	failed := errors.New("redis is down")
+	saved := func(name string) (string, error) {
+		if name == "broken" {
+			return "", failed
+		}
+		return views[name], nil
+	}
+	tests := []struct {
+		text, want string
+		err        error
+	}{
+		{"work", "tag:work status:open", nil},
+		{"home", "home", nil},
+		{"tag:work", "tag:work", nil},
+		{"work status:open", "work status:open", nil},
+		{"broken", "broken", failed},
+	}
+	for _, tt := range tests {
+		got, err := expandView(tt.text, saved)
+		if got != tt.want || err != tt.err {
+			t.Errorf("expandView(%q) = %q, %v, want %q, %v", tt.text, got, err, tt.want, tt.err)
+		}
+	}
+}
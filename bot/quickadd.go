@@ -0,0 +1,254 @@
+package bot
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Reasons a line of /add is rejected, next to the import ones. The row's Detail
+// is the token that could not be read.
+const (
+	reasonBadDifficulty = "bad_difficulty"
+	reasonBadTime       = "bad_time"
+	reasonUnknownFlag   = "unknown_flag"
+)
+
+// endOfDay is the time of a deadline given as a day only.
+const endOfDay = 23*time.Hour + 59*time.Minute
+
+// token is a word of a line of /add and the byte offset it starts at.
+type token struct {
+	text string
+	pos  int
+}
+
+func splitTokens(line string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range line {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				tokens = append(tokens, token{line[start:i], start})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{line[start:], start})
+	}
+	return tokens
+}
+
+// parseTaskLine reads one line of /add: the description with attributes mixed
+// in anywhere.
+//
+//	!3              difficulty 1-5
+//	^fri 17:00      deadline: today, tomorrow, a weekday, 2026-10-20, 20.10 or
+//	                20.10.2026, optionally followed by a time; ^17:00 alone is
+//	                the next 17:00
+//	#work           tag
+//	*remind, *r     turn the reminder on
+//	| 3             difficulty, the older form, at the end of the line
+//
+// @ works like ^, except that a word after @ that is not a day, such as a
+// mention, stays in the description. Other bad attributes fail the row with the
+// token in Detail and the text around it in Before and After. now is the current
+// time in the bot's time zone. Deadlines keep the wall clock in UTC, like
+// /set_deadline does.
+func parseTaskLine(n int, line string, now time.Time) importRow {
+	row := importRow{N: n, Status: importPending}
+	failAt := func(reason string, t token) {
+		// report the first error only, but read on for the description
+		if row.Status == importPending {
+			row.fail(reason, t.text)
+			row.Before = strings.TrimLeftFunc(line[:t.pos], unicode.IsSpace)
+			row.After = strings.TrimRightFunc(line[t.pos+len(t.text):], unicode.IsSpace)
+		}
+	}
+
+	end := len(line)
+	if bar := strings.LastIndex(line, "|"); bar >= 0 {
+		for _, t := range splitTokens(line[bar+1:]) {
+			t.pos += bar + 1
+			d, err := strconv.Atoi(t.text)
+			if err != nil || d < 1 || d > 5 {
+				failAt(reasonBadDifficulty, t)
+			} else {
+				row.Task.Difficulty = d
+			}
+		}
+		end = bar
+	}
+
+	var words []string
+	tokens := splitTokens(line[:end])
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		sigil, rest := t.text[0], t.text[1:]
+		switch {
+		case sigil == '!' && rest != "" && isDigit(rest[0]):
+			d, err := strconv.Atoi(rest)
+			if err != nil || d < 1 || d > 5 {
+				failAt(reasonBadDifficulty, t)
+				continue
+			}
+			row.Task.Difficulty = d
+		case sigil == '#' && strings.TrimFunc(rest, unicode.IsDigit) != "":
+			// #12 is more likely an issue number than a tag
+			row.Task.Tags = appendTag(row.Task.Tags, rest)
+		case sigil == '*' && rest != "" && strings.IndexFunc(rest, isNotLetter) < 0:
+			switch strings.ToLower(rest) {
+			case "remind", "r":
+				row.Task.ReminderExists = true
+			default:
+				failAt(reasonUnknownFlag, t)
+			}
+		case (sigil == '^' || sigil == '@') && rest != "":
+			day, ok := parseDay(rest, now)
+			var clock *token
+			switch {
+			case ok && i+1 < len(tokens) && looksLikeClock(tokens[i+1].text):
+				i++
+				clock = &tokens[i]
+			case !ok && looksLikeClock(rest):
+				// a time alone
+				ok, clock = true, &token{rest, t.pos + 1}
+			}
+			if !ok && sigil == '@' {
+				words = append(words, t.text)
+				continue
+			} else if !ok {
+				failAt(reasonBadDate, t)
+				continue
+			}
+			deadline, ok := withClock(day, clock, now)
+			if !ok {
+				failAt(reasonBadTime, *clock)
+				continue
+			}
+			if _, weekday := weekdays[strings.ToLower(rest)]; weekday && !deadline.After(wallClock(now)) {
+				// ^fri on a Friday evening is the next one
+				deadline = deadline.AddDate(0, 0, 7)
+			}
+			row.Task.Deadline = deadline
+		default:
+			words = append(words, t.text)
+		}
+	}
+	row.Task.Description = strings.Join(words, " ")
+	if row.Task.Description == "" && row.Status == importPending {
+		row.fail(reasonEmpty, "")
+	}
+	return row
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isNotLetter(r rune) bool { return !unicode.IsLetter(r) }
+
+func appendTag(tags []string, tag string) []string {
+	tag = strings.ToLower(tag)
+	for _, t := range tags {
+		if t == tag {
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
+
+// looksLikeClock reports whether s is meant as a time of day, such as 9:30 or
+// 25:00, valid or not.
+func looksLikeClock(s string) bool {
+	hours, minutes, ok := strings.Cut(s, ":")
+	if !ok || len(hours) == 0 || len(hours) > 2 || len(minutes) != 2 {
+		return false
+	}
+	for _, c := range []byte(hours + minutes) {
+		if !isDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday, "вс": time.Sunday, "воскресенье": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday, "пн": time.Monday, "понедельник": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday, "вт": time.Tuesday, "вторник": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday, "ср": time.Wednesday, "среда": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday, "чт": time.Thursday, "четверг": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday, "пт": time.Friday, "пятница": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday, "сб": time.Saturday, "суббота": time.Saturday,
+}
+
+// parseDay reads the day of a deadline as midnight UTC. A weekday is the next
+// such day, today included, and a day and month without a year the next such
+// date.
+func parseDay(s string, now time.Time) (time.Time, bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	s = strings.ToLower(s)
+	switch s {
+	case "today", "сегодня":
+		return today, true
+	case "tomorrow", "завтра":
+		return today.AddDate(0, 0, 1), true
+	}
+	if wd, ok := weekdays[s]; ok {
+		return today.AddDate(0, 0, (int(wd)-int(today.Weekday())+7)%7), true
+	}
+	if date, err := time.Parse("2006-01-02", s); err == nil {
+		return date, true
+	}
+	if date, err := time.Parse("02.01.2006", s); err == nil {
+		return date, true
+	}
+	date, err := time.Parse("02.01", s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	year := now.Year()
+	if time.Date(year, date.Month(), date.Day(), 0, 0, 0, 0, time.UTC).Before(today) {
+		year++
+	}
+	day := time.Date(year, date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	// 29.02 in a year that has no such day would otherwise become 01.03
+	if day.Month() != date.Month() {
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+// withClock puts the time of clock, or the end of the day without one, on day.
+// A zero day means the next such time from now.
+func withClock(day time.Time, clock *token, now time.Time) (time.Time, bool) {
+	if clock == nil {
+		return day.Add(endOfDay), true
+	}
+	t, err := time.Parse("15:04", clock.text)
+	if err != nil {
+		return time.Time{}, false
+	}
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if !day.IsZero() {
+		return day.Add(offset), true
+	}
+	deadline := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(offset)
+	if !deadline.After(wallClock(now)) {
+		deadline = deadline.AddDate(0, 0, 1)
+	}
+	return deadline, true
+}
+
+// wallClock is now with the wall clock kept in UTC, to compare with deadlines.
+func wallClock(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, time.UTC)
+}
+
+// wallNow is the current time in the bot's time zone, as deadlines keep it.
+func (bs *BotService) wallNow() time.Time {
+	return wallClock(time.Now().In(bs.opts.Location))
+}
@@ -0,0 +1,138 @@
+package bot
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+)
+
+// quickAddNow is a Wednesday evening in Moscow.
+var quickAddNow = time.Date(2026, 10, 21, 18, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+
+func wall(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseTaskLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		description string
+		difficulty  int
+		deadline    time.Time
+		tags        []string
+		reminder    bool
+	}{
+		{line: "Write report", description: "Write report"},
+		{line: "Write !3 report", description: "Write report", difficulty: 3},
+		{line: "Call mom ^tomorrow 17:00", description: "Call mom", deadline: wall(2026, 10, 22, 17, 0)},
+		{line: "Call mom ^завтра", description: "Call mom", deadline: wall(2026, 10, 22, 23, 59)},
+		{line: "Pay rent ^fri", description: "Pay rent", deadline: wall(2026, 10, 23, 23, 59)},
+		{line: "Standup ^wed 10:00", description: "Standup", deadline: wall(2026, 10, 28, 10, 0)},
+		{line: "Standup ^wed 19:00", description: "Standup", deadline: wall(2026, 10, 21, 19, 0)},
+		{line: "Lunch ^12:00", description: "Lunch", deadline: wall(2026, 10, 22, 12, 0)},
+		{line: "Dinner ^20:30", description: "Dinner", deadline: wall(2026, 10, 21, 20, 30)},
+		{line: "Trip ^2026-11-01 08:15", description: "Trip", deadline: wall(2026, 11, 1, 8, 15)},
+		{line: "Trip ^01.11.2026", description: "Trip", deadline: wall(2026, 11, 1, 23, 59)},
+		{line: "Birthday ^20.10", description: "Birthday", deadline: wall(2027, 10, 20, 23, 59)},
+		{line: "Ask @tomorrow 9:00", description: "Ask", deadline: wall(2026, 10, 22, 9, 0)},
+		{line: "Ask @alice about it", description: "Ask @alice about it"},
+		{line: "Fix #Work bug #work #12", description: "Fix bug #12", tags: []string{"work"}},
+		{line: "Backup *remind", description: "Backup", reminder: true},
+		{line: "Backup *R", description: "Backup", reminder: true},
+		{line: "2*3 is six", description: "2*3 is six"},
+		{line: "Report | 4", description: "Report", difficulty: 4},
+		{line: "Report ^fri 9:00 #work !2 *r", description: "Report", difficulty: 2, deadline: wall(2026, 10, 23, 9, 0), tags: []string{"work"}, reminder: true},
+	}
+	for _, tt := range tests {
+		row := parseTaskLine(1, tt.line, quickAddNow)
+		if row.Status != importPending {
+			t.Errorf("parseTaskLine(%q) failed: %s %q", tt.line, row.Reason, row.Detail)
+			continue
+		}
+		task := row.Task
+		if task.Description != tt.description || task.Difficulty != tt.difficulty || !task.Deadline.Equal(tt.deadline) ||
+			!slices.Equal(task.Tags, tt.tags) || task.ReminderExists != tt.reminder {
+			t.Errorf("parseTaskLine(%q) = %q difficulty %d deadline %v tags %q reminder %v, want %q %d %v %q %v",
+				tt.line, task.Description, task.Difficulty, task.Deadline, task.Tags, task.ReminderExists,
+				tt.description, tt.difficulty, tt.deadline, tt.tags, tt.reminder)
+		}
+	}
+}
+
+func TestParseTaskLineErrors(t *testing.T) {
+	tests := []struct {
+		line          string
+		reason        string
+		detail        string
+		before, after string
+	}{
+		{"Write !9 report", reasonBadDifficulty, "!9", "Write ", " report"},
+		{"Write !0", reasonBadDifficulty, "!0", "Write ", ""},
+		{"Report | 7", reasonBadDifficulty, "7", "Report | ", ""},
+		{"Report | high", reasonBadDifficulty, "high", "Report | ", ""},
+		{"Call ^someday please", reasonBadDate, "^someday", "Call ", " please"},
+		{"Call ^31.02", reasonBadDate, "^31.02", "Call ", ""},
+		{"Call ^29.02", reasonBadDate, "^29.02", "Call ", ""},
+		{"Call ^fri 25:00 now", reasonBadTime, "25:00", "Call ^fri ", " now"},
+		{"Call ^24:61", reasonBadTime, "24:61", "Call ^", ""},
+		{"Backup *soon", reasonUnknownFlag, "*soon", "Backup ", ""},
+		{"a !7 ^nope", reasonBadDifficulty, "!7", "a ", " ^nope"},
+		{"!3 #work", reasonEmpty, "", "", ""},
+		{"   ", reasonEmpty, "", "", ""},
+	}
+	for _, tt := range tests {
+		row := parseTaskLine(1, tt.line, quickAddNow)
+		if row.Status != importFailed || row.Reason != tt.reason || row.Detail != tt.detail ||
+			row.Before != tt.before || row.After != tt.after {
+			t.Errorf("parseTaskLine(%q) = %s %s %q between %q and %q, want failed %s %q between %q and %q",
+				tt.line, row.Status, row.Reason, row.Detail, row.Before, row.After,
+				tt.reason, tt.detail, tt.before, tt.after)
+		}
+	}
+}
+
+func TestParseTaskLineKeepsDescriptionOnError(t *testing.T) {
+	row := parseTaskLine(1, "Write !9 the report", quickAddNow)
+	if row.Task.Description != "Write the report" {
+		t.Errorf("description = %q, want %q", row.Task.Description, "Write the report")
+	}
+}
+
+func FuzzParseTaskLine(f *testing.F) {
+	for _, line := range []string{
+		"Write report !3 ^fri 17:00 #work *remind",
+		"Ask @alice @tomorrow 9:00",
+		"Lunch ^12:00 | 2",
+		"Call ^fri 25:00",
+		"x !9 *nope ^never | 0",
+		"^",
+		"| |",
+		"#12 #Работа *r ^пт",
+		" !3\tтекст\n^20.10",
+		"\xff^\xfe 1:00",
+	} {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		row := parseTaskLine(1, line, quickAddNow)
+		if row.Status != importPending && row.Status != importFailed {
+			t.Fatalf("status %q", row.Status)
+		}
+		if row.Status == importFailed && row.Reason == "" {
+			t.Fatal("failed without a reason")
+		}
+		if row.Detail == "" {
+			return
+		}
+		// Before, Detail and After are consecutive parts of the line
+		end := len(strings.TrimRightFunc(line, unicode.IsSpace)) - len(row.After)
+		pos := end - len(row.Detail)
+		if pos < 0 || end > len(line) || line[pos:end] != row.Detail ||
+			!strings.HasSuffix(line[:end+len(row.After)], row.After) ||
+			strings.TrimLeftFunc(line[:pos], unicode.IsSpace) != row.Before {
+			t.Fatalf("token %q between %q and %q is not in %q", row.Detail, row.Before, row.After, line)
+		}
+	})
+}
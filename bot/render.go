@@ -0,0 +1,230 @@
+package bot
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+// pluralRules picks the index of the plural form for n, in the order the forms
+// are passed to the plural template function.
+var pluralRules = map[string]func(n int) int{
+	// one, few, many
+	"ru": func(n int) int {
+		n %= 100
+		switch {
+		case n%10 == 1 && n != 11:
+			return 0
+		case n%10 >= 2 && n%10 <= 4 && (n < 12 || n > 14):
+			return 1
+		}
+		return 2
+	},
+	// one, other
+	"en": func(n int) int {
+		if n == 1 {
+			return 0
+		}
+		return 1
+	},
+}
+
+// catalogs holds the replies of the bot, one template set per language, parsed
+// from templates/<language>.tmpl.
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]*template.Template {
+	files, err := fs.Glob(templateFS, "templates/*.tmpl")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]*template.Template, len(files))
+	for _, file := range files {
+		lang := strings.TrimSuffix(path.Base(file), ".tmpl")
+		rule, ok := pluralRules[lang]
+		if !ok {
+			panic("no plural rule for language " + lang)
+		}
+		catalogs[lang] = template.Must(template.New("").Funcs(template.FuncMap{
+			"deadline": formatDeadline,
+			"userURL":  userURL,
+			"overdue":  overdue,
+			"until":    timeLeft,
+			"parts":    durationParts,
+			"plural": func(n int, forms ...string) string {
+				return forms[min(rule(n), len(forms)-1)]
+			},
+		}).ParseFS(templateFS, file))
+	}
+	return catalogs
+}
+
+// Languages returns the languages the bot has a catalog for.
+func Languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+// CheckCatalogs reports templates that exist in one catalog but not in another.
+func CheckCatalogs() error {
+	keys := make(map[string][]string)
+	for _, lang := range Languages() {
+		for _, t := range catalogs[lang].Templates() {
+			if t.Name() != "" && !strings.HasSuffix(t.Name(), ".tmpl") {
+				keys[t.Name()] = append(keys[t.Name()], lang)
+			}
+		}
+	}
+	var missing []string
+	for name, langs := range keys {
+		if len(langs) != len(catalogs) {
+			missing = append(missing, fmt.Sprintf("%q only in %s", name, strings.Join(langs, ", ")))
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Errorf("message catalogs differ: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// view is the data of a template that needs more than one value.
+type view map[string]any
+
+// listItem is one line of a task listing. Description is already shortened to
+// fit the page.
+type listItem struct {
+	Task
+	N           int
+	Description string
+	Group       bool
+}
+
+// durationPart is one unit of a duration, such as 3 hours. Unit is day, hour,
+// minute or second, the templates pick the words.
+type durationPart struct {
+	N    int
+	Unit string
+}
+
+// durationParts splits d into days, hours and minutes, leaving out zeros.
+// Anything shorter than a minute is given in seconds.
+func durationParts(d time.Duration) []durationPart {
+	if d < time.Minute {
+		return []durationPart{{N: max(int(d.Round(time.Second).Seconds()), 0), Unit: "second"}}
+	}
+	d = d.Round(time.Minute)
+	var parts []durationPart
+	for _, u := range []struct {
+		size time.Duration
+		unit string
+	}{{24 * time.Hour, "day"}, {time.Hour, "hour"}, {time.Minute, "minute"}} {
+		if n := int(d / u.size); n > 0 {
+			parts = append(parts, durationPart{N: n, Unit: u.unit})
+			d -= time.Duration(n) * u.size
+		}
+	}
+	return parts
+}
+
+func formatDeadline(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// deadlineZone is the time zone deadlines are wall clocks of, for the template
+// functions, which are shared by every BotService. NewBotService sets it.
+var deadlineZone atomic.Pointer[time.Location]
+
+// deadlineNow is now on the wall clock of deadlineZone, to compare with deadlines.
+func deadlineNow() time.Time {
+	loc := deadlineZone.Load()
+	if loc == nil {
+		loc = time.Local
+	}
+	return wallClock(time.Now().In(loc))
+}
+
+func overdue(deadline time.Time) bool {
+	return !deadline.After(deadlineNow())
+}
+
+func timeLeft(deadline time.Time) time.Duration {
+	return deadline.Sub(deadlineNow())
+}
+
+// render executes the template name from the catalog of lang.
+func render(lang, name string, data any) (string, error) {
+	catalog, ok := catalogs[lang]
+	if !ok {
+		return "", fmt.Errorf("no message catalog for language %q", lang)
+	}
+	var b strings.Builder
+	if err := catalog.ExecuteTemplate(&b, name, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// reply renders the template name in the language of the chat and sends it to chatID.
+func (bs *BotService) reply(ctx context.Context, chatID int64, name string, data any) error {
+	return bs.replyWith(ctx, chatID, name, data, false)
+}
+
+// prompt is reply for messages that ask for more input. In groups the answer must
+// be a reply to the bot, so the user is asked for one.
+func (bs *BotService) prompt(ctx context.Context, chatID int64, name string, data any) error {
+	return bs.replyWith(ctx, chatID, name, data, true)
+}
+
+func (bs *BotService) replyWith(ctx context.Context, chatID int64, name string, data any, forceReply bool) error {
+	text, err := render(bs.language(ctx, chatID), name, data)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", name, "error", err)
+		return err
+	}
+	return bs.sendHTML(ctx, chatID, text, forceReply)
+}
+
+// sendHTML sends text in Telegram's HTML parse mode, split into several messages
+// if it is longer than Telegram allows. In groups the first message quotes the
+// one being answered.
+func (bs *BotService) sendHTML(ctx context.Context, chatID int64, text string, forceReply bool) error {
+	o, ok := originFrom(ctx)
+	inGroup := ok && o.Group && o.ChatID == chatID
+	parts := SplitHTML(text, maxMessageLength)
+	for i, part := range parts {
+		msg := tgbotapi.NewMessage(chatID, part)
+		msg.ParseMode = tgbotapi.ModeHTML
+		if inGroup && i == 0 {
+			msg.ReplyToMessageID = o.MessageID
+			msg.AllowSendingWithoutReply = true
+		}
+		if inGroup && forceReply && i == len(parts)-1 {
+			msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+		}
+		if err := bs.send(ctx, chatID, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
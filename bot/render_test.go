@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatalogsHaveSameKeys(t *testing.T) {
+	if err := CheckCatalogs(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPluralForms(t *testing.T) {
+	tests := []struct {
+		lang string
+		n    int
+		want string
+	}{
+		{"ru", 1, "1 символ."},
+		{"ru", 2, "2 символа."},
+		{"ru", 5, "5 символов."},
+		{"ru", 11, "11 символов."},
+		{"ru", 21, "21 символ."},
+		{"en", 1, "1 character."},
+		{"en", 2, "2 characters."},
+	}
+	for _, tt := range tests {
+		got, err := render(tt.lang, "add.too_long", view{"Max": tt.n})
+		if err != nil {
+			t.Fatalf("render(%s, %d): %v", tt.lang, tt.n, err)
+		}
+		if !strings.HasSuffix(got, tt.want) {
+			t.Errorf("render(%s, %d) = %q, want it to end with %q", tt.lang, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestTimeLeftUsesDeadlineZone(t *testing.T) {
+	defer deadlineZone.Store(deadlineZone.Load())
+	// twelve hours behind UTC, so a deadline an hour ahead there is long past in UTC
+	deadlineZone.Store(time.FixedZone("UTC-12", -12*60*60))
+
+	deadline := wallClock(time.Now().In(time.FixedZone("UTC-12", -12*60*60))).Add(time.Hour)
+	if overdue(deadline) {
+		t.Errorf("overdue(%v) = true an hour before the deadline", deadline)
+	}
+	if left := timeLeft(deadline); left < 59*time.Minute || left > time.Hour {
+		t.Errorf("timeLeft(%v) = %v, want about an hour", deadline, left)
+	}
+	if !overdue(deadline.Add(-2 * time.Hour)) {
+		t.Errorf("overdue(%v) = false an hour after the deadline", deadline.Add(-2*time.Hour))
+	}
+}
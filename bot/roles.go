@@ -0,0 +1,306 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Role is what a member may do with the shared list of a group. Group
+// administrators are always owners, everybody else is an editor until an owner
+// says otherwise. In private chats the user owns their list.
+type Role string
+
+const (
+	// RoleOwner may change every task of the list and give roles.
+	RoleOwner Role = "owner"
+	// RoleEditor may add tasks and change the tasks they created or are
+	// assigned to. Only the author may delete a task.
+	RoleEditor Role = "editor"
+	// RoleViewer may only look at the list.
+	RoleViewer Role = "viewer"
+)
+
+func parseRole(s string) (Role, bool) {
+	switch r := Role(strings.ToLower(s)); r {
+	case RoleOwner, RoleEditor, RoleViewer:
+		return r, true
+	}
+	return "", false
+}
+
+// action is a change to the list that needs a permission check.
+type action int
+
+const (
+	actionAdd action = iota
+	actionChange
+	actionDelete
+)
+
+// adminsTTL is how long the administrators of a group are cached. Promoting or
+// demoting an administrator takes effect after at most this long.
+const adminsTTL = 10 * time.Minute
+
+func chatRolesKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:roles", chatID)
+}
+
+func chatAdminsKey(chatID int64) string {
+	return fmt.Sprintf("chat:%d:admins", chatID)
+}
+
+// isChatAdmin reports whether userID administers the group, asking Telegram
+// through getChatAdministrators when the cached list has expired.
+func (bs *BotService) isChatAdmin(ctx context.Context, chatID, userID int64) (bool, error) {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	key := chatAdminsKey(chatID)
+	n, err := bs.rdb.Exists(redisCtx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		members, err := bs.api.GetChatAdministrators(tgbotapi.ChatAdministratorsConfig{
+			ChatConfig: tgbotapi.ChatConfig{ChatID: chatID},
+		})
+		if err != nil {
+			return false, err
+		}
+		// 0 keeps the set from being empty, Redis would not store it then
+		ids := []any{0}
+		for _, member := range members {
+			if member.User != nil {
+				ids = append(ids, member.User.ID)
+			}
+		}
+		pipe := bs.rdb.TxPipeline()
+		pipe.Del(redisCtx, key)
+		pipe.SAdd(redisCtx, key, ids...)
+		pipe.Expire(redisCtx, key, adminsTTL)
+		if _, err := pipe.Exec(redisCtx); err != nil {
+			return false, err
+		}
+	}
+	return bs.rdb.SIsMember(redisCtx, key, userID).Result()
+}
+
+// roleOf returns the role of userID in the list of chatID.
+func (bs *BotService) roleOf(ctx context.Context, chatID, userID int64) (Role, error) {
+	if chatID > 0 {
+		return RoleOwner, nil
+	}
+	admin, err := bs.isChatAdmin(ctx, chatID, userID)
+	if err != nil {
+		return "", err
+	}
+	if admin {
+		return RoleOwner, nil
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	role, err := bs.rdb.HGet(redisCtx, chatRolesKey(chatID), strconv.FormatInt(userID, 10)).Result()
+	if err == redis.Nil {
+		return RoleEditor, nil
+	} else if err != nil {
+		return "", err
+	}
+	role, _, _ = strings.Cut(role, ":")
+	if r, ok := parseRole(role); ok {
+		return r, nil
+	}
+	return RoleEditor, nil
+}
+
+// permits reports whether role may do act to task. task is nil for actionAdd.
+func permits(role Role, userID int64, act action, task *Task) bool {
+	switch role {
+	case RoleOwner:
+		return true
+	case RoleEditor:
+		if act == actionAdd {
+			return true
+		}
+		if task.CreatedBy == userID {
+			return true
+		}
+		if act == actionDelete {
+			return false
+		}
+		for _, a := range task.Assignees {
+			if a.ID == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorize checks that the sender may do act to the task matching filter, and
+// replies why not otherwise. A filter that matches nothing is allowed, so the
+// command reports the missing task itself. filter is nil for actionAdd. The task
+// found is returned so the command changes that one and no other.
+func (bs *BotService) authorize(ctx context.Context, chatID int64, act action, filter bson.M) (*Task, bool) {
+	o, ok := originFrom(ctx)
+	if chatID > 0 || !ok || o.From == nil {
+		return nil, true
+	}
+
+	role, err := bs.roleOf(ctx, chatID, o.From.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get role", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return nil, false
+	}
+	if role == RoleViewer {
+		bs.reply(ctx, chatID, "denied.viewer", nil)
+		return nil, false
+	}
+	if act == actionAdd || role == RoleOwner {
+		return nil, true
+	}
+
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	var task Task
+	err = bs.db.FindOne(dbCtx, filter).Decode(&task)
+	if err == mongo.ErrNoDocuments {
+		return nil, true
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to find task", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return nil, false
+	}
+	if !permits(role, o.From.ID, act, &task) {
+		if act == actionDelete {
+			bs.reply(ctx, chatID, "denied.delete", view{"Description": task.Description})
+		} else {
+			bs.reply(ctx, chatID, "denied.change", view{"Description": task.Description})
+		}
+		return nil, false
+	}
+	return &task, true
+}
+
+// SetRole handles /role in a group. Without arguments it shows the roles of the
+// list; /role @member owner|editor|viewer, or the same as a reply to the
+// member's message, lets an owner change one.
+func (bs *BotService) SetRole(ctx context.Context, chatID int64, message *tgbotapi.Message, text string) {
+	o, ok := originFrom(ctx)
+	if !ok || !o.Group || o.From == nil {
+		bs.reply(ctx, chatID, "group_only", nil)
+		return
+	}
+
+	role, err := bs.roleOf(ctx, chatID, o.From.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get role", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		bs.showRoles(ctx, chatID, role)
+		return
+	}
+	if role != RoleOwner {
+		bs.reply(ctx, chatID, "role.owner_only", nil)
+		return
+	}
+
+	newRole, ok := parseRole(args[len(args)-1])
+	if !ok {
+		bs.reply(ctx, chatID, "role.usage", nil)
+		return
+	}
+	members, unknown, err := bs.resolveAssignees(ctx, message, args[:len(args)-1])
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to resolve members", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	if len(unknown) > 0 {
+		bs.reply(ctx, chatID, "assign.unknown_user", view{"Names": unknown})
+		return
+	}
+	if len(members) != 1 {
+		bs.reply(ctx, chatID, "role.usage", nil)
+		return
+	}
+	member := members[0]
+
+	admin, err := bs.isChatAdmin(ctx, chatID, member.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get chat administrators", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	if admin {
+		bs.reply(ctx, chatID, "role.admin", view{"Member": member})
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	field := strconv.FormatInt(member.ID, 10)
+	if newRole == RoleEditor {
+		err = bs.rdb.HDel(redisCtx, chatRolesKey(chatID), field).Err()
+	} else {
+		// the name is kept next to the role for showRoles
+		err = bs.rdb.HSet(redisCtx, chatRolesKey(chatID), field, string(newRole)+":"+member.Name).Err()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save role", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	bs.reply(ctx, chatID, "role.set", view{"Member": member, "Role": string(newRole)})
+}
+
+// roleEntry is a member with a role other than the default in /role.
+type roleEntry struct {
+	Member Assignee
+	Role   string
+}
+
+func (bs *BotService) showRoles(ctx context.Context, chatID int64, own Role) {
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	roles, err := bs.rdb.HGetAll(redisCtx, chatRolesKey(chatID)).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get roles", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+
+	var entries []roleEntry
+	for field, value := range roles {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		role, name, _ := strings.Cut(value, ":")
+		entries = append(entries, roleEntry{Member: Assignee{ID: id, Name: name}, Role: role})
+	}
+	slices.SortFunc(entries, func(a, b roleEntry) int {
+		return cmp.Or(strings.Compare(a.Role, b.Role), strings.Compare(a.Member.Name, b.Member.Name))
+	})
+	bs.reply(ctx, chatID, "role.list", view{"Role": string(own), "Entries": entries})
+}
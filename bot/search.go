@@ -0,0 +1,381 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// searchLimit is the number of results /search shows, suggestLimit the
+	// number of tasks offered when a description does not match exactly.
+	searchLimit  = 10
+	suggestLimit = 5
+	// fuzzyScanLimit bounds the tasks of a chat compared with the query when
+	// the text index finds nothing.
+	fuzzyScanLimit = 1000
+	// fuzzyThreshold is the lowest similarity that counts as a match.
+	fuzzyThreshold = 0.6
+	// pickTTL is how long the buttons offered for an inexact description work.
+	pickTTL = 15 * time.Minute
+	// pickLabelLength is the longest description shown on a button.
+	pickLabelLength = 40
+)
+
+// searchHit is a task found for a query, with its rank.
+type searchHit struct {
+	Task  `bson:",inline"`
+	Score float64 `bson:"score"`
+}
+
+// searchTasks returns up to limit tasks of the chat that match query, best
+// first: those the text index finds, which knows word forms, then those with a
+// description close to the query, which catches typos.
+func (bs *BotService) searchTasks(ctx context.Context, chatID int64, query string, limit int) ([]Task, error) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	defer cancel()
+
+	score := bson.M{"$meta": "textScore"}
+	findOptions := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}}).
+		SetLimit(int64(limit))
+	cursor, err := bs.db.Find(dbCtx, bson.M{"chat_id": chatID, "$text": bson.M{"$search": query}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var hits []searchHit
+	if err := cursor.All(dbCtx, &hits); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[primitive.ObjectID]bool, len(hits))
+	tasks := make([]Task, 0, limit)
+	for _, hit := range hits {
+		seen[hit.ID] = true
+		tasks = append(tasks, hit.Task)
+	}
+	if len(tasks) == limit {
+		return tasks, nil
+	}
+
+	cursor, err = bs.db.Find(dbCtx, bson.M{"chat_id": chatID},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(fuzzyScanLimit))
+	if err != nil {
+		return nil, err
+	}
+	var all []Task
+	if err := cursor.All(dbCtx, &all); err != nil {
+		return nil, err
+	}
+	var fuzzy []searchHit
+	for _, task := range all {
+		if s := similarity(query, task.Description); s >= fuzzyThreshold && !seen[task.ID] {
+			fuzzy = append(fuzzy, searchHit{Task: task, Score: s})
+		}
+	}
+	slices.SortStableFunc(fuzzy, func(a, b searchHit) int { return cmp.Compare(b.Score, a.Score) })
+	for _, hit := range fuzzy {
+		if len(tasks) == limit {
+			break
+		}
+		tasks = append(tasks, hit.Task)
+	}
+	return tasks, nil
+}
+
+// normalizeText lowercases s, folds ё into е and collapses whitespace, so that
+// comparisons ignore how a description was typed.
+func normalizeText(s string) string {
+	s = strings.ReplaceAll(strings.ToLower(s), "ё", "е")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// similarity rates from 0 to 1 how close text is to query: 1 for the same text,
+// 0.9 when text has the query at the start of a word, and otherwise the better
+// of the edit distance of the whole texts and of each query word to its closest
+// word in text.
+func similarity(query, text string) float64 {
+	q, t := normalizeText(query), normalizeText(text)
+	if q == "" || t == "" {
+		return 0
+	}
+	if q == t {
+		return 1
+	}
+	if strings.Contains(" "+t, " "+q) {
+		return 0.9
+	}
+
+	queryWords, textWords := strings.Fields(q), strings.Fields(t)
+	var sum float64
+	for _, qw := range queryWords {
+		best := 0.0
+		for _, tw := range textWords {
+			best = max(best, editSimilarity(qw, tw))
+		}
+		sum += best
+	}
+	// matching words alone do not make the same task
+	words := 0.9 * sum / float64(len(queryWords))
+	return max(editSimilarity(q, t), words)
+}
+
+// editSimilarity is 1 minus the Levenshtein distance of a and b relative to the
+// longer of them.
+func editSimilarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+// Search handles /search <query>: the tasks of the chat ranked by how well they
+// match.
+func (bs *BotService) Search(ctx context.Context, chatID int64, query string) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		bs.prompt(ctx, chatID, "search.ask", nil)
+		return
+	}
+
+	tasks, err := bs.searchTasks(ctx, chatID, query, searchLimit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to search tasks", "error", err)
+		bs.reply(ctx, chatID, "search.failed", nil)
+		return
+	}
+	if len(tasks) == 0 {
+		bs.reply(ctx, chatID, "search.empty", view{"Query": query})
+		return
+	}
+
+	budget := (maxMessageLength-100)/searchLimit - listLineOverhead
+	items := make([]listItem, len(tasks))
+	for i, task := range tasks {
+		items[i] = listItem{Task: task, N: i + 1, Description: truncate(task.Description, budget), Group: chatID < 0}
+	}
+	bs.rememberShown(ctx, chatID, "search:"+listQueryToken(query), items)
+	bs.reply(ctx, chatID, "search", view{"Query": query, "Items": items})
+}
+
+// pickAction is a command waiting for the user to pick the task it is for,
+// among the tasks in IDs. Arg is the rest of the command, such as the new
+// description of /edit.
+type pickAction struct {
+	Command string   `json:"command"`
+	Arg     string   `json:"arg,omitempty"`
+	IDs     []string `json:"ids"`
+}
+
+func pickKey(chatID int64, token string) string {
+	return fmt.Sprintf("chat:%d:pick:%s", chatID, token)
+}
+
+// findTask returns the task of the chat described by text. When no description
+// is exactly text, the closest tasks are offered as buttons that finish action
+// with the task picked, or notFound is sent when nothing is close; either way
+// ok is false.
+func (bs *BotService) findTask(ctx context.Context, chatID int64, text string, action pickAction, notFound string) (task Task, ok bool) {
+	dbCtx, cancel := bs.mongoContext(ctx)
+	err := bs.db.FindOne(dbCtx, bson.M{"chat_id": chatID, "description": text}).Decode(&task)
+	cancel()
+	if err == nil {
+		return task, true
+	} else if err != mongo.ErrNoDocuments {
+		slog.ErrorContext(ctx, "Failed to find task", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return task, false
+	}
+
+	tasks, err := bs.searchTasks(ctx, chatID, text, suggestLimit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to search tasks", "error", err)
+		bs.reply(ctx, chatID, notFound, nil)
+		return task, false
+	}
+	if len(tasks) == 0 {
+		bs.reply(ctx, chatID, notFound, nil)
+		return task, false
+	}
+	if len(tasks) == 1 && normalizeText(tasks[0].Description) == normalizeText(text) {
+		// only case or spacing differ
+		return tasks[0], true
+	}
+	bs.offerTasks(ctx, chatID, text, action, tasks)
+	return task, false
+}
+
+// offerTasks asks which of tasks was meant, one button each. The buttons carry
+// "pick:<token>:<index>", the action waits in Redis under the token, as the
+// new description of /edit could not fit in the 64 bytes of callback data.
+func (bs *BotService) offerTasks(ctx context.Context, chatID int64, text string, action pickAction, tasks []Task) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		slog.ErrorContext(ctx, "Failed to generate pick token", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	action.IDs = make([]string, len(tasks))
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(tasks)+1)
+	for i, task := range tasks {
+		action.IDs[i] = task.ID.Hex()
+		label := truncate(task.Description, pickLabelLength)
+		if task.Mark {
+			label = "✅ " + label
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, "pick:"+token+":"+strconv.Itoa(i))))
+	}
+
+	lang := bs.language(ctx, chatID)
+	cancelLabel, err := render(lang, "pick.cancel", nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "pick.cancel", "error", err)
+		return
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(cancelLabel, "pick:"+token+":x")))
+	question, err := render(lang, "pick.ask", view{"Text": text})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render message", "template", "pick.ask", "error", err)
+		return
+	}
+
+	payload, err := json.Marshal(action)
+	if err == nil {
+		redisCtx, cancel := bs.redisContext(ctx)
+		err = bs.rdb.Set(redisCtx, pickKey(chatID, token), payload, pickTTL).Err()
+		cancel()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save pick", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, question)
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if o, ok := originFrom(ctx); ok && o.Group && o.ChatID == chatID {
+		msg.ReplyToMessageID = o.MessageID
+		msg.AllowSendingWithoutReply = true
+	}
+	bs.send(ctx, chatID, msg)
+}
+
+// PickTask handles a press on a button of offerTasks. data is
+// "pick:<token>:<index>", or "pick:<token>:x" for the cancel button.
+func (bs *BotService) PickTask(ctx context.Context, message *tgbotapi.Message, data string) {
+	chatID := message.Chat.ID
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 {
+		slog.WarnContext(ctx, "Malformed pick callback", "data", data)
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	payload, err := bs.rdb.GetDel(redisCtx, pickKey(chatID, parts[1])).Bytes()
+	cancel()
+	if err == redis.Nil {
+		bs.reply(ctx, chatID, "pick.expired", nil)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to get pick", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	var action pickAction
+	if err := json.Unmarshal(payload, &action); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode pick", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+
+	bs.send(ctx, chatID, tgbotapi.NewEditMessageReplyMarkup(chatID, message.MessageID,
+		tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+	if parts[2] == "x" {
+		return
+	}
+	i, err := strconv.Atoi(parts[2])
+	if err != nil || i < 0 || i >= len(action.IDs) {
+		slog.WarnContext(ctx, "Malformed pick callback", "data", data)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(action.IDs[i])
+	if err != nil {
+		slog.WarnContext(ctx, "Malformed pick", "id", action.IDs[i])
+		return
+	}
+
+	var task Task
+	dbCtx, cancel := bs.mongoContext(ctx)
+	err = bs.db.FindOne(dbCtx, bson.M{"_id": id, "chat_id": chatID}).Decode(&task)
+	cancel()
+	if err == mongo.ErrNoDocuments {
+		bs.reply(ctx, chatID, "task.not_changed", nil)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to find task", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+
+	switch action.Command {
+	case "is_done":
+		bs.markDone(ctx, chatID, task)
+	case "edit":
+		bs.renameTask(ctx, chatID, task, action.Arg)
+	case "set_deadline":
+		if action.Arg == "" {
+			if _, ok := bs.authorize(ctx, chatID, actionChange, bson.M{"chat_id": chatID, "description": task.Description}); ok {
+				bs.showDeadlinePicker(ctx, chatID, task)
+			}
+			return
+		}
+		deadline, err := time.Parse("2006-01-02 15:04", action.Arg)
+		if err != nil {
+			slog.WarnContext(ctx, "Malformed pick", "arg", action.Arg)
+			return
+		}
+		bs.setTaskDeadline(ctx, chatID, task, deadline)
+	case "set_reminder", "unset_reminder":
+		bs.toggleReminder(ctx, chatID, task, action.Command == "set_reminder", bs.clientAsynq)
+	default:
+		slog.WarnContext(ctx, "Unknown pick command", "command", action.Command)
+	}
+}
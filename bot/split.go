@@ -0,0 +1,169 @@
+package bot
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxMessageLength is Telegram's limit for one message. It is counted in UTF-16
+// code units, the same way Telegram counts entity offsets.
+const maxMessageLength = 4096
+
+func textLength(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// SplitMessage cuts text into parts of at most limit UTF-16 code units. It cuts
+// after a newline when it can, then after a space, and only then inside a word,
+// always on a rune boundary, so a line of formatted text is never torn apart
+// unless it alone is longer than a whole message.
+func SplitMessage(text string, limit int) []string {
+	var parts []string
+	for textLength(text) > limit {
+		cut := cutIndex(text, limit)
+		parts = append(parts, strings.TrimRight(text[:cut], "\n"))
+		text = text[cut:]
+	}
+	if text != "" || len(parts) == 0 {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+// cutIndex returns the byte index to cut text at so text[:i] fits in limit.
+func cutIndex(text string, limit int) int {
+	n, end := 0, 0
+	lastNewline, lastSpace := -1, -1
+	for i, r := range text {
+		n += utf16.RuneLen(r)
+		if n > limit {
+			break
+		}
+		end = i + utf8.RuneLen(r)
+		switch r {
+		case '\n':
+			lastNewline = end
+		case ' ':
+			lastSpace = end
+		}
+	}
+	switch {
+	case lastNewline > 0:
+		return lastNewline
+	case lastSpace > 0:
+		return lastSpace
+	case end == 0:
+		// limit is smaller than the first rune, take it anyway so the caller makes progress
+		_, size := utf8.DecodeRuneInString(text)
+		return size
+	}
+	return end
+}
+
+// htmlReserve is room left in every part for the closing tags SplitHTML adds.
+const htmlReserve = 64
+
+var htmlTag = regexp.MustCompile(`<(/?)([a-zA-Z-]+)[^>]*>`)
+
+// SplitHTML is SplitMessage for text in Telegram's HTML parse mode. It never cuts
+// inside a tag or an entity, closes the tags still open at the end of a part and
+// opens them again at the start of the next one.
+func SplitHTML(text string, limit int) []string {
+	var parts []string
+	var open []string
+	for {
+		prefix := strings.Join(open, "")
+		if textLength(prefix)+textLength(text) <= limit {
+			return append(parts, prefix+text)
+		}
+		cut := htmlCutIndex(text, limit-textLength(prefix)-htmlReserve)
+		part := prefix + text[:cut]
+		open = openTags(part)
+		parts = append(parts, strings.TrimRight(part, "\n")+closeTags(open))
+		text = text[cut:]
+	}
+}
+
+// htmlCutIndex is cutIndex that steps back out of a tag or an entity.
+func htmlCutIndex(text string, limit int) int {
+	cut := cutIndex(text, limit)
+	head := text[:cut]
+	if lt := strings.LastIndexByte(head, '<'); lt > strings.LastIndexByte(head, '>') && lt > 0 {
+		cut = lt
+	} else if amp := strings.LastIndexByte(head, '&'); amp > strings.LastIndexByte(head, ';') && amp > 0 {
+		cut = amp
+	}
+	return cut
+}
+
+// openTags returns the opening tags in html that are not closed by its end.
+func openTags(html string) []string {
+	var open []string
+	for _, m := range htmlTag.FindAllStringSubmatch(html, -1) {
+		if m[1] == "" {
+			open = append(open, m[0])
+			continue
+		}
+		for i := len(open) - 1; i >= 0; i-- {
+			if tagName(open[i]) == m[2] {
+				open = append(open[:i], open[i+1:]...)
+				break
+			}
+		}
+	}
+	return open
+}
+
+func closeTags(open []string) string {
+	var b strings.Builder
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + tagName(open[i]) + ">")
+	}
+	return b.String()
+}
+
+func tagName(tag string) string {
+	return htmlTag.FindStringSubmatch(tag)[2]
+}
+
+// truncate shortens s to at most limit UTF-16 code units, marking the cut with an ellipsis.
+func truncate(s string, limit int) string {
+	if textLength(s) <= limit {
+		return s
+	}
+	n := 0
+	for i, r := range s {
+		n += utf16.RuneLen(r)
+		if n > limit-1 {
+			return s[:i] + "…"
+		}
+	}
+	return s
+}
+
+// truncateEscaped is truncate for text that goes into an HTML message, where
+// html/template turns &, <, >, ' and " into entities several units long.
+func truncateEscaped(s string, limit int) string {
+	if escapedLength(s) <= limit {
+		return s
+	}
+	n := 0
+	for i, r := range s {
+		n += escapedLength(string(r))
+		if n > limit-1 {
+			return s[:i] + "…"
+		}
+	}
+	return s
+}
+
+func escapedLength(s string) int {
+	return textLength(html.EscapeString(s))
+}
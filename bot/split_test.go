@@ -0,0 +1,125 @@
+package bot
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  []string
+	}{
+		{"", 10, []string{""}},
+		{"short", 10, []string{"short"}},
+		{"one two\nthree four", 12, []string{"one two", "three four"}},
+		{"one two three four", 12, []string{"one two ", "three four"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		// 😀 is two UTF-16 code units and does not fit after "ab"
+		{"ab😀cd", 3, []string{"ab", "😀c", "d"}},
+		{"😀😀", 1, []string{"😀", "😀"}},
+	}
+	for _, tt := range tests {
+		if got := SplitMessage(tt.text, tt.limit); !slices.Equal(got, tt.want) {
+			t.Errorf("SplitMessage(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestSplitHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{
+			name:  "fits",
+			text:  "<b>bold</b> &amp; plain",
+			limit: 100,
+			want:  []string{"<b>bold</b> &amp; plain"},
+		},
+		{
+			name:  "cut inside <b>",
+			text:  "<b>" + strings.Repeat("word ", 20) + "</b> tail",
+			limit: htmlReserve + 16,
+			want: append(slices.Repeat([]string{"<b>word word </b>"}, 4),
+				"<b>word word word word word word word word word word word word </b> tail"),
+		},
+		{
+			name:  "cut inside &amp;",
+			text:  "aaaaaaaa&amp;" + strings.Repeat("b", 65),
+			limit: htmlReserve + 10,
+			want:  []string{"aaaaaaaa", "&amp;" + strings.Repeat("b", 65)},
+		},
+		{
+			name:  "cut inside a tag",
+			text:  "aaaaaaaa<i>it</i>" + strings.Repeat("c", 65),
+			limit: htmlReserve + 10,
+			want:  []string{"aaaaaaaa", "<i>it</i>" + strings.Repeat("c", 65)},
+		},
+	}
+	for _, tt := range tests {
+		got := SplitHTML(tt.text, tt.limit)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: SplitHTML = %q, want %q", tt.name, got, tt.want)
+		}
+		for _, part := range got {
+			if n := textLength(part); n > tt.limit {
+				t.Errorf("%s: part %q is %d long, limit %d", tt.name, part, n, tt.limit)
+			}
+			if open := openTags(part); len(open) > 0 {
+				t.Errorf("%s: part %q leaves %q open", tt.name, part, open)
+			}
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s     string
+		limit int
+		want  string
+	}{
+		{"hello", 5, "hello"},
+		{"hello world", 6, "hello…"},
+		{"ab😀", 4, "ab😀"},
+		{"ab😀", 3, "ab…"},
+		// the ellipsis must not leave half of 😀 behind
+		{"a😀b", 3, "a…"},
+		{"привет", 4, "при…"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.limit); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateEscaped(t *testing.T) {
+	tests := []struct {
+		s     string
+		limit int
+		want  string
+	}{
+		{"a&b", 7, "a&b"},
+		// & becomes &amp; and does not fit next to the ellipsis
+		{"a&b", 6, "a…"},
+		{"a&b", 5, "a…"},
+		{"<b>x</b>", 6, "<b…"},
+		{"Tom & Jerry", 10, "Tom &…"},
+		{"Tom & Jerry", 9, "Tom …"},
+		{"a😀b", 3, "a…"},
+	}
+	for _, tt := range tests {
+		got := truncateEscaped(tt.s, tt.limit)
+		if got != tt.want {
+			t.Errorf("truncateEscaped(%q, %d) = %q, want %q", tt.s, tt.limit, got, tt.want)
+		}
+		if n := escapedLength(got); n > tt.limit {
+			t.Errorf("truncateEscaped(%q, %d) is %d long once escaped", tt.s, tt.limit, n)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+func userTimezoneKey(userID int64) string {
+	return fmt.Sprintf("user:%d:timezone", userID)
+}
+
+// loadTimezone reads a time zone name such as Europe/Berlin or UTC. It does not
+// take "Local" or "", which would be the time zone of the server.
+func loadTimezone(name string) (*time.Location, bool) {
+	if name == "" || strings.EqualFold(name, "local") {
+		return nil, false
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, false
+	}
+	return loc, true
+}
+
+// userLocation returns the time zone userID chose with /timezone, or the bot's
+// when they did not choose one.
+func (bs *BotService) userLocation(ctx context.Context, userID int64) *time.Location {
+	if userID == 0 {
+		return bs.opts.Location
+	}
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	name, err := bs.rdb.Get(redisCtx, userTimezoneKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		slog.ErrorContext(ctx, "Failed to get user time zone", "error", err)
+	}
+	if loc, ok := loadTimezone(name); ok {
+		return loc
+	}
+	return bs.opts.Location
+}
+
+// toZone turns a deadline, the wall clock of the bot's time zone kept in UTC,
+// into the wall clock of loc, kept in UTC the same way. fromZone undoes it.
+func (bs *BotService) toZone(deadline time.Time, loc *time.Location) time.Time {
+	return moveWallClock(deadline, bs.opts.Location, loc)
+}
+
+func (bs *BotService) fromZone(t time.Time, loc *time.Location) time.Time {
+	return moveWallClock(t, loc, bs.opts.Location)
+}
+
+// deadlineInstant is the moment deadline, a wall clock of the bot's time zone
+// kept in UTC, comes.
+func (bs *BotService) deadlineInstant(deadline time.Time) time.Time {
+	return time.Date(deadline.Year(), deadline.Month(), deadline.Day(), deadline.Hour(), deadline.Minute(), deadline.Second(), 0, bs.opts.Location)
+}
+
+func moveWallClock(t time.Time, from, to *time.Location) time.Time {
+	if from.String() == to.String() {
+		return t
+	}
+	instant := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, from)
+	return wallClock(instant.In(to))
+}
+
+// SetTimezone handles /timezone [Area/City|auto]: the time zone the agenda of
+// the user is grouped by days in. Without an argument it shows the current one.
+func (bs *BotService) SetTimezone(ctx context.Context, chatID, userID int64, text string) {
+	arg := strings.TrimSpace(text)
+	if arg == "" {
+		bs.reply(ctx, chatID, "timezone.current", view{"Timezone": bs.userLocation(ctx, userID).String()})
+		return
+	}
+
+	redisCtx, cancel := bs.redisContext(ctx)
+	defer cancel()
+
+	if strings.EqualFold(arg, "auto") {
+		if err := bs.rdb.Del(redisCtx, userTimezoneKey(userID)).Err(); err != nil {
+			slog.ErrorContext(ctx, "Failed to reset user time zone", "error", err)
+			bs.reply(ctx, chatID, "error.later", nil)
+			return
+		}
+		bs.reply(ctx, chatID, "timezone.set", view{"Timezone": bs.opts.Location.String()})
+		return
+	}
+
+	loc, ok := loadTimezone(arg)
+	if !ok {
+		bs.reply(ctx, chatID, "timezone.unknown", view{"Timezone": arg})
+		return
+	}
+	if err := bs.rdb.Set(redisCtx, userTimezoneKey(userID), loc.String(), 0).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to save user time zone", "error", err)
+		bs.reply(ctx, chatID, "error.later", nil)
+		return
+	}
+	bs.reply(ctx, chatID, "timezone.set", view{"Timezone": loc.String()})
+}
@@ -1,36 +1,432 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
+// Config holds every tunable of the bot. Values are resolved in this order, later
+// sources overriding earlier ones: built-in defaults, the YAML config file, environment
+// variables, command-line flags.
 type Config struct {
-	TelegramToken           string
-	MongoDBURI              string
-	MongoDBDatabase         string
-	RedisURI                string
-	RedisPassword           string
-	RedisDB                 int
-	ReminderIntervalMinutes int
+	TelegramToken           string        `yaml:"telegram_token"`
+	TelegramDebug           bool          `yaml:"telegram_debug"`
+	MongoDBURI              string        `yaml:"mongodb_uri"`
+	MongoDBDatabase         string        `yaml:"mongodb_database"`
+	MongoDBCollection       string        `yaml:"mongodb_collection"`
+	RedisURI                string        `yaml:"redis_uri"`
+	RedisPassword           string        `yaml:"redis_password"`
+	RedisDB                 int           `yaml:"redis_db"`
+	AsynqConcurrency        int           `yaml:"asynq_concurrency"`
+	ReminderIntervalMinutes int           `yaml:"reminder_interval_minutes"`
+	ReminderTimezone        string        `yaml:"reminder_timezone"`
+	CommandStateTTL         time.Duration `yaml:"command_state_ttl"`
+	DispatcherWorkers       int           `yaml:"dispatcher_workers"`
+	DispatcherQueueSize     int           `yaml:"dispatcher_queue_size"`
+	HandlerTimeout          time.Duration `yaml:"handler_timeout"`
+	MongoTimeout            time.Duration `yaml:"mongodb_timeout"`
+	RedisTimeout            time.Duration `yaml:"redis_timeout"`
+	ShutdownTimeout         time.Duration `yaml:"shutdown_timeout"`
+	TelegramGlobalRate      int           `yaml:"telegram_global_rate"`
+	TelegramChatRate        int           `yaml:"telegram_chat_rate"`
+	OutboxWorkers           int           `yaml:"outbox_workers"`
+	OutboxMaxQueue          int           `yaml:"outbox_max_queue"`
+	OutboxMaxRetries        int           `yaml:"outbox_max_retries"`
+	RateLimitRead           int           `yaml:"rate_limit_read"`
+	RateLimitWrite          int           `yaml:"rate_limit_write"`
+	RateLimitOther          int           `yaml:"rate_limit_other"`
+	RateLimitWindow         time.Duration `yaml:"rate_limit_window"`
+	RateLimitStrikes        int           `yaml:"rate_limit_strikes"`
+	BanDuration             time.Duration `yaml:"ban_duration"`
+	MaxTasksPerChat         int           `yaml:"max_tasks_per_chat"`
+	MaxDescriptionLength    int           `yaml:"max_description_length"`
+	AdminIDs                string        `yaml:"admin_ids"`
+	ListPageSize            int           `yaml:"list_page_size"`
+	DefaultLanguage         string        `yaml:"default_language"`
+	CalendarBaseURL         string        `yaml:"calendar_base_url"`
+	HTTPAddr                string        `yaml:"http_addr"`
+	HealthCheckTimeout      time.Duration `yaml:"health_check_timeout"`
+	TelegramPollMaxAge      time.Duration `yaml:"telegram_poll_max_age"`
+	TraceExporter           string        `yaml:"trace_exporter"`
+	TraceFile               string        `yaml:"trace_file"`
+	TraceOTLPEndpoint       string        `yaml:"trace_otlp_endpoint"`
+	LogFormat               string        `yaml:"log_format"`
+	LogLevel                string        `yaml:"log_level"`
+	LogRedact               bool          `yaml:"log_redact"`
+
+	// PrintConfig is set by --print-config and is not a tunable itself.
+	PrintConfig bool `yaml:"-"`
+}
+
+func Default() Config {
+	return Config{
+		TelegramDebug:           false,
+		MongoDBCollection:       "tasks",
+		RedisDB:                 0,
+		AsynqConcurrency:        10,
+		ReminderIntervalMinutes: 1,
+		ReminderTimezone:        "Europe/Moscow",
+		CommandStateTTL:         time.Minute,
+		DispatcherWorkers:       8,
+		DispatcherQueueSize:     64,
+		HandlerTimeout:          30 * time.Second,
+		MongoTimeout:            10 * time.Second,
+		RedisTimeout:            3 * time.Second,
+		ShutdownTimeout:         30 * time.Second,
+		TelegramGlobalRate:      30,
+		TelegramChatRate:        1,
+		OutboxWorkers:           4,
+		OutboxMaxQueue:          1000,
+		OutboxMaxRetries:        3,
+		RateLimitRead:           20,
+		RateLimitWrite:          30,
+		RateLimitOther:          30,
+		RateLimitWindow:         time.Minute,
+		RateLimitStrikes:        5,
+		BanDuration:             time.Hour,
+		MaxTasksPerChat:         500,
+		MaxDescriptionLength:    500,
+		ListPageSize:            10,
+		DefaultLanguage:         "ru",
+		HTTPAddr:                ":8080",
+		HealthCheckTimeout:      5 * time.Second,
+		TelegramPollMaxAge:      3 * time.Minute,
+		TraceExporter:           "stdout",
+		TraceFile:               "traces.json",
+		LogFormat:               "text",
+		LogLevel:                "info",
+		LogRedact:               true,
+	}
+}
+
+// setting binds one Config field to its environment variable and command-line flag.
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  any
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"TELEGRAM_TOKEN", "telegram-token", "Telegram bot API token", true, &c.TelegramToken},
+		{"TELEGRAM_DEBUG", "telegram-debug", "log raw Telegram API traffic", false, &c.TelegramDebug},
+		{"MONGODB_URI", "mongodb-uri", "MongoDB connection URI", true, &c.MongoDBURI},
+		{"MONGODB_DATABASE", "mongodb-database", "MongoDB database name", false, &c.MongoDBDatabase},
+		{"MONGODB_COLLECTION", "mongodb-collection", "MongoDB collection for tasks", false, &c.MongoDBCollection},
+		{"REDIS_URI", "redis-uri", "Redis address (host:port)", false, &c.RedisURI},
+		{"REDIS_PASSWORD", "redis-password", "Redis password", true, &c.RedisPassword},
+		{"REDIS_DB", "redis-db", "Redis database number", false, &c.RedisDB},
+		{"ASYNQ_CONCURRENCY", "asynq-concurrency", "number of concurrent asynq workers", false, &c.AsynqConcurrency},
+		{"REMINDER_INTERVAL_MINUTES", "reminder-interval-minutes", "minutes between deadline checks", false, &c.ReminderIntervalMinutes},
+		{"REMINDER_TIMEZONE", "reminder-timezone", "IANA time zone used for deadline checks", false, &c.ReminderTimezone},
+		{"COMMAND_STATE_TTL", "command-state-ttl", "how long a pending command waits for its arguments", false, &c.CommandStateTTL},
+		{"DISPATCHER_WORKERS", "dispatcher-workers", "number of update handler goroutines", false, &c.DispatcherWorkers},
+		{"DISPATCHER_QUEUE_SIZE", "dispatcher-queue-size", "queued updates per worker before polling blocks", false, &c.DispatcherQueueSize},
+		{"HANDLER_TIMEOUT", "handler-timeout", "time limit for handling one update", false, &c.HandlerTimeout},
+		{"MONGODB_TIMEOUT", "mongodb-timeout", "time limit for one MongoDB operation", false, &c.MongoTimeout},
+		{"REDIS_TIMEOUT", "redis-timeout", "time limit for one Redis operation", false, &c.RedisTimeout},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "time limit for a graceful shutdown", false, &c.ShutdownTimeout},
+		{"TELEGRAM_GLOBAL_RATE", "telegram-global-rate", "outgoing messages per second across all chats", false, &c.TelegramGlobalRate},
+		{"TELEGRAM_CHAT_RATE", "telegram-chat-rate", "outgoing messages per second to one chat", false, &c.TelegramChatRate},
+		{"OUTBOX_WORKERS", "outbox-workers", "goroutines sending queued messages", false, &c.OutboxWorkers},
+		{"OUTBOX_MAX_QUEUE", "outbox-max-queue", "queued outgoing messages before sends are refused", false, &c.OutboxMaxQueue},
+		{"OUTBOX_MAX_RETRIES", "outbox-max-retries", "retries for a message after 429 or network errors", false, &c.OutboxMaxRetries},
+		{"RATE_LIMIT_READ", "rate-limit-read", "list and stats commands per user per window, 0 for no limit", false, &c.RateLimitRead},
+		{"RATE_LIMIT_WRITE", "rate-limit-write", "commands changing tasks per user per window, 0 for no limit", false, &c.RateLimitWrite},
+		{"RATE_LIMIT_OTHER", "rate-limit-other", "other commands and messages per user per window, 0 for no limit", false, &c.RateLimitOther},
+		{"RATE_LIMIT_WINDOW", "rate-limit-window", "window for the per-user rate limits", false, &c.RateLimitWindow},
+		{"RATE_LIMIT_STRIKES", "rate-limit-strikes", "throttled windows before a temporary ban, 0 to never ban", false, &c.RateLimitStrikes},
+		{"BAN_DURATION", "ban-duration", "length of a temporary ban", false, &c.BanDuration},
+		{"MAX_TASKS_PER_CHAT", "max-tasks-per-chat", "tasks a chat may store, 0 for no limit", false, &c.MaxTasksPerChat},
+		{"MAX_DESCRIPTION_LENGTH", "max-description-length", "characters allowed in a task description, 0 for no limit", false, &c.MaxDescriptionLength},
+		{"ADMIN_IDS", "admin-ids", "comma-separated Telegram user IDs allowed to /ban and /unban", false, &c.AdminIDs},
+		{"LIST_PAGE_SIZE", "list-page-size", "tasks per page of /list, at most 30", false, &c.ListPageSize},
+		{"DEFAULT_LANGUAGE", "default-language", "reply language when the user's Telegram language has no catalog", false, &c.DefaultLanguage},
+		{"CALENDAR_BASE_URL", "calendar-base-url", "public URL of the HTTP server for calendar feeds, empty to disable /calendar", false, &c.CalendarBaseURL},
+		{"HTTP_ADDR", "http-addr", "listen address for the metrics and health endpoints, empty to disable", false, &c.HTTPAddr},
+		{"HEALTH_CHECK_TIMEOUT", "health-check-timeout", "time limit for all readiness checks", false, &c.HealthCheckTimeout},
+		{"TELEGRAM_POLL_MAX_AGE", "telegram-poll-max-age", "readiness fails when Telegram was not polled for this long", false, &c.TelegramPollMaxAge},
+		{"TRACE_EXPORTER", "trace-exporter", "where spans go: stdout, file, otlp or none", false, &c.TraceExporter},
+		{"TRACE_FILE", "trace-file", "output file for the file trace exporter", false, &c.TraceFile},
+		{"TRACE_OTLP_ENDPOINT", "trace-otlp-endpoint", "OTLP/HTTP endpoint URL for the otlp trace exporter", false, &c.TraceOTLPEndpoint},
+		{"LOG_FORMAT", "log-format", "log output format: text or json", false, &c.LogFormat},
+		{"LOG_LEVEL", "log-level", "minimum log level: debug, info, warn or error", false, &c.LogLevel},
+		{"LOG_REDACT", "log-redact", "redact secrets and message content in logs", false, &c.LogRedact},
+	}
+}
+
+// LoadConfig resolves the configuration from defaults, the config file, the environment
+// and args (without the program name) and validates the result.
+func LoadConfig(args []string) (Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("bot", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file (env CONFIG_FILE)")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print the resolved configuration with secrets masked and exit")
+
+	flagValues := map[string]string{}
+	for _, s := range cfg.settings() {
+		name := s.flag
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		record := func(v string) error {
+			flagValues[name] = v
+			return nil
+		}
+		if _, ok := s.value.(*bool); ok {
+			fs.BoolFunc(name, usage, record)
+		} else {
+			fs.Func(name, usage, record)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return cfg, err
+		}
+	}
+
+	var errs []error
+	for _, s := range cfg.settings() {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := parseInto(s.value, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	for _, s := range cfg.settings() {
+		if v, ok := flagValues[s.flag]; ok {
+			if err := parseInto(s.value, v); err != nil {
+				errs = append(errs, fmt.Errorf("--%s: %w", s.flag, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cfg, errors.Join(errs...)
+	}
+
+	// --print-config should work even when the configuration is incomplete
+	if cfg.PrintConfig {
+		return cfg, nil
+	}
+	return cfg, cfg.Validate()
 }
 
-func LoadConfig() Config {
-	err := godotenv.Load()
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Println("Error loading .env file")
+		return fmt.Errorf("failed to open config file: %w", err)
 	}
+	defer f.Close()
 
-	return Config{
-		TelegramToken:           os.Getenv("TELEGRAM_TOKEN"),
-		MongoDBURI:              os.Getenv("MONGODB_URI"),
-		MongoDBDatabase:         os.Getenv("MONGODB_DATABASE"),
-		RedisURI:                os.Getenv("REDIS_URI"),
-		RedisPassword:           os.Getenv("REDIS_PASSWORD"),
-		ReminderIntervalMinutes: 1,
-		RedisDB:                 0,
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
 	}
+	return nil
+}
+
+func parseInto(dst any, value string) error {
+	switch p := dst.(type) {
+	case *string:
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (examples: 30s, 5m, 1h)", value)
+		}
+		*p = d
+	default:
+		return fmt.Errorf("unsupported setting type %T", dst)
+	}
+	return nil
+}
 
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	required := func(value, env string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Errorf("%s is required", env))
+		}
+	}
+	positive := func(value int, env string) {
+		if value < 1 {
+			errs = append(errs, fmt.Errorf("%s must be at least 1, got %d", env, value))
+		}
+	}
+	nonNegative := func(value int, env string) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", env, value))
+		}
+	}
+	positiveDuration := func(value time.Duration, env string) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive duration, got %s", env, value))
+		}
+	}
+
+	required(c.TelegramToken, "TELEGRAM_TOKEN")
+	required(c.MongoDBURI, "MONGODB_URI")
+	required(c.MongoDBDatabase, "MONGODB_DATABASE")
+	required(c.MongoDBCollection, "MONGODB_COLLECTION")
+	required(c.RedisURI, "REDIS_URI")
+
+	if c.MongoDBURI != "" && !strings.HasPrefix(c.MongoDBURI, "mongodb://") && !strings.HasPrefix(c.MongoDBURI, "mongodb+srv://") {
+		errs = append(errs, errors.New("MONGODB_URI must start with mongodb:// or mongodb+srv://"))
+	}
+	if c.RedisDB < 0 || c.RedisDB > 15 {
+		errs = append(errs, fmt.Errorf("REDIS_DB must be between 0 and 15, got %d", c.RedisDB))
+	}
+	if _, err := time.LoadLocation(c.ReminderTimezone); err != nil {
+		errs = append(errs, fmt.Errorf("REMINDER_TIMEZONE %q is not a known time zone", c.ReminderTimezone))
+	}
+	switch c.TraceExporter {
+	case "none", "stdout":
+	case "file":
+		required(c.TraceFile, "TRACE_FILE")
+	case "otlp":
+		required(c.TraceOTLPEndpoint, "TRACE_OTLP_ENDPOINT")
+	default:
+		errs = append(errs, fmt.Errorf("TRACE_EXPORTER must be stdout, file, otlp or none, got %q", c.TraceExporter))
+	}
+	nonNegative(c.RateLimitRead, "RATE_LIMIT_READ")
+	nonNegative(c.RateLimitWrite, "RATE_LIMIT_WRITE")
+	nonNegative(c.RateLimitOther, "RATE_LIMIT_OTHER")
+	nonNegative(c.RateLimitStrikes, "RATE_LIMIT_STRIKES")
+	nonNegative(c.MaxTasksPerChat, "MAX_TASKS_PER_CHAT")
+	nonNegative(c.MaxDescriptionLength, "MAX_DESCRIPTION_LENGTH")
+	if c.ListPageSize < 1 || c.ListPageSize > 30 {
+		errs = append(errs, fmt.Errorf("LIST_PAGE_SIZE must be between 1 and 30, got %d", c.ListPageSize))
+	}
+	if c.CalendarBaseURL != "" {
+		if !strings.HasPrefix(c.CalendarBaseURL, "https://") && !strings.HasPrefix(c.CalendarBaseURL, "http://") {
+			errs = append(errs, errors.New("CALENDAR_BASE_URL must start with https:// or http://"))
+		}
+		if c.HTTPAddr == "" {
+			errs = append(errs, errors.New("CALENDAR_BASE_URL needs HTTP_ADDR to serve the feeds"))
+		}
+	}
+	positiveDuration(c.RateLimitWindow, "RATE_LIMIT_WINDOW")
+	positiveDuration(c.BanDuration, "BAN_DURATION")
+	if _, err := c.Admins(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be text or json, got %q", c.LogFormat))
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	if c.DispatcherQueueSize < 0 {
+		errs = append(errs, fmt.Errorf("DISPATCHER_QUEUE_SIZE must not be negative, got %d", c.DispatcherQueueSize))
+	}
+
+	positive(c.AsynqConcurrency, "ASYNQ_CONCURRENCY")
+	positive(c.ReminderIntervalMinutes, "REMINDER_INTERVAL_MINUTES")
+	positive(c.DispatcherWorkers, "DISPATCHER_WORKERS")
+	positive(c.TelegramGlobalRate, "TELEGRAM_GLOBAL_RATE")
+	positive(c.TelegramChatRate, "TELEGRAM_CHAT_RATE")
+	positive(c.OutboxWorkers, "OUTBOX_WORKERS")
+	positive(c.OutboxMaxQueue, "OUTBOX_MAX_QUEUE")
+	if c.OutboxMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("OUTBOX_MAX_RETRIES must not be negative, got %d", c.OutboxMaxRetries))
+	}
+	positiveDuration(c.CommandStateTTL, "COMMAND_STATE_TTL")
+	positiveDuration(c.HandlerTimeout, "HANDLER_TIMEOUT")
+	positiveDuration(c.MongoTimeout, "MONGODB_TIMEOUT")
+	positiveDuration(c.RedisTimeout, "REDIS_TIMEOUT")
+	positiveDuration(c.ShutdownTimeout, "SHUTDOWN_TIMEOUT")
+	positiveDuration(c.HealthCheckTimeout, "HEALTH_CHECK_TIMEOUT")
+	positiveDuration(c.TelegramPollMaxAge, "TELEGRAM_POLL_MAX_AGE")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Admins parses AdminIDs.
+func (c Config) Admins() (map[int64]bool, error) {
+	admins := make(map[int64]bool)
+	for _, field := range strings.Split(c.AdminIDs, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_IDS: %q is not a Telegram user ID", field)
+		}
+		admins[id] = true
+	}
+	return admins, nil
+}
+
+// Print writes the resolved configuration as env-style lines with secrets masked.
+func (c Config) Print(w io.Writer) {
+	for _, s := range c.settings() {
+		value := formatValue(s.value)
+		if s.secret {
+			value = mask(s.env, value)
+		}
+		fmt.Fprintf(w, "%s=%s\n", s.env, value)
+	}
+}
+
+func formatValue(v any) string {
+	switch p := v.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+func mask(env, value string) string {
+	if value == "" {
+		return ""
+	}
+	if env == "MONGODB_URI" {
+		u, err := url.Parse(value)
+		if err != nil {
+			return "****"
+		}
+		return u.Redacted()
+	}
+	return "****"
 }
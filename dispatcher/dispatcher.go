@@ -0,0 +1,128 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"go_mod/logging"
+	"go_mod/tracing"
+)
+
+// Handler processes a single update. ctx is cancelled when the per-update timeout expires
+// or when the context passed to Start is cancelled.
+type Handler func(ctx context.Context, update tgbotapi.Update)
+
+// Dispatcher shards updates by chat ID across a fixed set of workers:
+// updates from different chats run in parallel, updates from one chat run in order.
+type Dispatcher struct {
+	handler Handler
+	timeout time.Duration
+	ctx     context.Context
+	shards  []chan tgbotapi.Update
+	wg      sync.WaitGroup
+}
+
+func NewDispatcher(workers, queueSize int, timeout time.Duration, handler Handler) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	d := &Dispatcher{
+		handler: handler,
+		timeout: timeout,
+		shards:  make([]chan tgbotapi.Update, workers),
+	}
+	for i := range d.shards {
+		d.shards[i] = make(chan tgbotapi.Update, queueSize)
+	}
+	return d
+}
+
+func (d *Dispatcher) Start(ctx context.Context) {
+	d.ctx = ctx
+	for i := range d.shards {
+		d.wg.Add(1)
+		go d.worker(d.shards[i])
+	}
+}
+
+// Dispatch queues the update on its chat's shard. It blocks while the shard queue
+// is full, which pushes back on the update poller, and gives up when ctx is done.
+func (d *Dispatcher) Dispatch(ctx context.Context, update tgbotapi.Update) error {
+	shard := d.shards[d.shardFor(update)]
+	select {
+	case shard <- update:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop closes the shard queues and waits until every queued update has been handled.
+// Dispatch must not be called after Stop.
+func (d *Dispatcher) Stop() {
+	for _, shard := range d.shards {
+		close(shard)
+	}
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) shardFor(update tgbotapi.Update) int {
+	var chatID int64
+	if chat := update.FromChat(); chat != nil {
+		chatID = chat.ID
+	}
+	// group chat IDs are negative, so shard on the unsigned value
+	return int(uint64(chatID) % uint64(len(d.shards)))
+}
+
+func (d *Dispatcher) worker(updates <-chan tgbotapi.Update) {
+	defer d.wg.Done()
+	for update := range updates {
+		d.handle(update)
+	}
+}
+
+func (d *Dispatcher) handle(update tgbotapi.Update) {
+	base := logging.With(d.ctx, "update_id", update.UpdateID)
+	if chat := update.FromChat(); chat != nil {
+		base = logging.With(base, "chat_id", chat.ID)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if d.timeout > 0 {
+		ctx, cancel = context.WithTimeout(base, d.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(base)
+	}
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "telegram.update", attribute.Int("update_id", update.UpdateID))
+	defer span.End()
+
+	defer func() {
+		if r := recover(); r != nil {
+			span.SetStatus(codes.Error, fmt.Sprint(r))
+			slog.ErrorContext(ctx, "Panic while handling update", "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	start := time.Now()
+	d.handler(ctx, update)
+	if ctx.Err() == context.DeadlineExceeded {
+		slog.WarnContext(ctx, "Update exceeded handler timeout", "timeout", d.timeout, "took", time.Since(start))
+	}
+}
@@ -0,0 +1,139 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func message(updateID int, chatID int64) tgbotapi.Update {
+	return tgbotapi.Update{UpdateID: updateID, Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chatID}}}
+}
+
+func TestDispatchKeepsChatOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[int64][]int)
+	d := NewDispatcher(4, 8, time.Second, func(ctx context.Context, update tgbotapi.Update) {
+		// later updates of a chat finish first if they are not run in order
+		time.Sleep(time.Duration(10-update.UpdateID%10) * 100 * time.Microsecond)
+		mu.Lock()
+		defer mu.Unlock()
+		chatID := update.FromChat().ID
+		seen[chatID] = append(seen[chatID], update.UpdateID)
+	})
+	d.Start(context.Background())
+
+	chats := []int64{1, 2, -100123, 42}
+	for i := 0; i < 100; i++ {
+		if err := d.Dispatch(context.Background(), message(i, chats[i%len(chats)])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Stop()
+
+	for i, chatID := range chats {
+		got := seen[chatID]
+		if len(got) != 100/len(chats) {
+			t.Errorf("chat %d: handled %d updates, want %d", chatID, len(got), 100/len(chats))
+		}
+		for j, id := range got {
+			if want := i + j*len(chats); id != want {
+				t.Errorf("chat %d: update %d handled as number %d, want %d", chatID, id, j, want)
+				break
+			}
+		}
+	}
+}
+
+func TestDispatchRunsChatsInParallel(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan int64, 2)
+	d := NewDispatcher(2, 1, time.Second, func(ctx context.Context, update tgbotapi.Update) {
+		started <- update.FromChat().ID
+		<-release
+	})
+	d.Start(context.Background())
+	defer d.Stop()
+
+	// chats 1 and 2 land on different shards of two
+	for i, chatID := range []int64{1, 2} {
+		if err := d.Dispatch(context.Background(), message(i, chatID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("a slow chat blocked another one")
+		}
+	}
+	close(release)
+}
+
+func TestStopDrainsQueuedUpdates(t *testing.T) {
+	var mu sync.Mutex
+	handled := 0
+	d := NewDispatcher(1, 10, time.Second, func(ctx context.Context, update tgbotapi.Update) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+	d.Start(context.Background())
+	for i := 0; i < 10; i++ {
+		if err := d.Dispatch(context.Background(), message(i, 7)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Stop()
+	if handled != 10 {
+		t.Errorf("handled %d updates before Stop returned, want 10", handled)
+	}
+}
+
+func TestDispatchGivesUpWhenQueueIsFull(t *testing.T) {
+	release := make(chan struct{})
+	d := NewDispatcher(1, 0, time.Second, func(ctx context.Context, update tgbotapi.Update) {
+		<-release
+	})
+	d.Start(context.Background())
+	defer d.Stop()
+	defer close(release)
+
+	if err := d.Dispatch(context.Background(), message(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.Dispatch(ctx, message(2, 1)); err != context.DeadlineExceeded {
+		t.Errorf("Dispatch on a full queue = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestHandlerTimeoutAndPanic(t *testing.T) {
+	var mu sync.Mutex
+	var errs []error
+	d := NewDispatcher(1, 2, 10*time.Millisecond, func(ctx context.Context, update tgbotapi.Update) {
+		if update.UpdateID == 1 {
+			panic("boom")
+		}
+		<-ctx.Done()
+		mu.Lock()
+		errs = append(errs, ctx.Err())
+		mu.Unlock()
+	})
+	d.Start(context.Background())
+	for i := 1; i <= 2; i++ {
+		if err := d.Dispatch(context.Background(), message(i, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Stop()
+	if len(errs) != 1 || errs[0] != context.DeadlineExceeded {
+		t.Errorf("after a panic the next update got %v, want it cancelled by the timeout", errs)
+	}
+}
@@ -0,0 +1,176 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check reports whether one dependency is usable. It must respect ctx.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker serves liveness and readiness endpoints. Readiness runs every registered
+// check in parallel and reports each dependency separately.
+type Checker struct {
+	timeout time.Duration
+	mu      sync.RWMutex
+	checks  []namedCheck
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+type checkResult struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+type report struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// LivenessHandler answers 200 as long as the process can serve HTTP.
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, report{Status: "ok"})
+	})
+}
+
+// ReadinessHandler answers 200 when every check passes and 503 otherwise.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+		defer cancel()
+
+		results := c.run(ctx)
+		status, code := "ok", http.StatusOK
+		for name, result := range results {
+			if result.Status != "ok" {
+				status, code = "unavailable", http.StatusServiceUnavailable
+				slog.WarnContext(ctx, "Readiness check failed", "check", name, "error", result.Error)
+			}
+		}
+		writeJSON(w, code, report{Status: status, Checks: results})
+	})
+}
+
+func (c *Checker) run(ctx context.Context) map[string]checkResult {
+	c.mu.RLock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]checkResult, len(checks))
+	for _, nc := range checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := runCheck(ctx, nc.check)
+			result := checkResult{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			results[nc.name] = result
+			mu.Unlock()
+		}(nc)
+	}
+	wg.Wait()
+	return results
+}
+
+// runCheck stops waiting when ctx expires, even if the check itself ignores ctx.
+func runCheck(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("check panicked: %v", r)
+			}
+		}()
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out: %w", ctx.Err())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Failed to write health response", "error", err)
+	}
+}
+
+// HTTPClient matches the client interface of the Telegram bot API package.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// PollTracker wraps the Telegram HTTP client and records when getUpdates last
+// returned successfully, so readiness can tell a stalled poller from a quiet chat.
+type PollTracker struct {
+	Client   HTTPClient
+	lastPoll atomic.Int64
+}
+
+func (p *PollTracker) Do(req *http.Request) (*http.Response, error) {
+	resp, err := p.Client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusOK && strings.HasSuffix(req.URL.Path, "/getUpdates") {
+		p.lastPoll.Store(time.Now().UnixNano())
+	}
+	return resp, err
+}
+
+// LastPoll returns the time of the last successful getUpdates call, zero if none.
+func (p *PollTracker) LastPoll() time.Time {
+	n := p.lastPoll.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Check fails when no poll has succeeded within maxAge. The first poll only
+// returns after the long-poll timeout, so startup counts as a successful poll.
+func (p *PollTracker) Check(startedAt time.Time, maxAge time.Duration) Check {
+	return func(ctx context.Context) error {
+		last := p.LastPoll()
+		if last.IsZero() {
+			last = startedAt
+		}
+		if age := time.Since(last); age > maxAge {
+			return errors.New("no successful Telegram poll for " + age.Round(time.Second).String())
+		}
+		return nil
+	}
+}
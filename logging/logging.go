@@ -0,0 +1,165 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const redacted = "[REDACTED]"
+
+// Keys whose values are replaced when redaction is on. Message text, task
+// descriptions and callback data, which can carry a task, are user content;
+// token and password are secrets.
+var sensitiveKeys = map[string]bool{
+	"text":        true,
+	"description": true,
+	"data":        true,
+	"token":       true,
+	"password":    true,
+}
+
+var (
+	botTokenPattern = regexp.MustCompile(`\d{6,}:[A-Za-z0-9_-]{30,}`)
+	uriUserPattern  = regexp.MustCompile(`(://[^:/@\s]+):[^@\s]+@`)
+)
+
+// New builds a logger writing format ("text" or "json") at level ("debug", "info", "warn", "error").
+// Attributes stored in the context with With are added to every record.
+func New(w io.Writer, format, level string, redact bool) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	if redact {
+		opts.ReplaceAttr = redactAttr
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[a.Key] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Scrub(err.Error()))
+		}
+	}
+	return a
+}
+
+// Scrub removes bot tokens and URI credentials from s. Telegram API errors
+// include the request URL, which carries the token.
+func Scrub(s string) string {
+	s = botTokenPattern.ReplaceAllString(s, redacted)
+	return uriUserPattern.ReplaceAllString(s, "$1:"+redacted+"@")
+}
+
+type ctxKey struct{}
+
+// With returns a context whose log records carry attrs in addition to any already stored.
+func With(ctx context.Context, attrs ...any) context.Context {
+	existing, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(existing)+len(attrs)/2)
+	merged = append(merged, existing...)
+	merged = append(merged, argsToAttrs(attrs)...)
+	return context.WithValue(ctx, ctxKey{}, merged)
+}
+
+func argsToAttrs(args []any) []slog.Attr {
+	var r slog.Record
+	r.Add(args...)
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return attrs
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// TelegramLogger routes the Telegram client's output through slog. The client only
+// uses Printf for Debug traffic dumps and Println for polling errors.
+type TelegramLogger struct {
+	Logger *slog.Logger
+	// Redact drops request and response payloads, which carry user messages.
+	Redact bool
+}
+
+func (l TelegramLogger) Println(v ...interface{}) {
+	l.Logger.Warn(Scrub(strings.TrimSuffix(fmt.Sprintln(v...), "\n")), "component", "telegram")
+}
+
+func (l TelegramLogger) Printf(format string, v ...interface{}) {
+	if l.Redact {
+		endpoint := ""
+		if len(v) > 0 {
+			endpoint, _ = v[0].(string)
+		}
+		l.Logger.Debug("Telegram API call", "component", "telegram", "endpoint", endpoint)
+		return
+	}
+	l.Logger.Debug(Scrub(strings.TrimSpace(fmt.Sprintf(format, v...))), "component", "telegram")
+}
+
+// AsynqLogger routes the asynq server's output through slog.
+type AsynqLogger struct {
+	Logger *slog.Logger
+}
+
+func (l AsynqLogger) Debug(args ...interface{}) { l.log(slog.LevelDebug, args) }
+func (l AsynqLogger) Info(args ...interface{})  { l.log(slog.LevelInfo, args) }
+func (l AsynqLogger) Warn(args ...interface{})  { l.log(slog.LevelWarn, args) }
+func (l AsynqLogger) Error(args ...interface{}) { l.log(slog.LevelError, args) }
+
+func (l AsynqLogger) Fatal(args ...interface{}) {
+	l.log(slog.LevelError, args)
+	os.Exit(1)
+}
+
+func (l AsynqLogger) log(level slog.Level, args []interface{}) {
+	l.Logger.Log(context.Background(), level, Scrub(fmt.Sprint(args...)), "component", "asynq")
+}
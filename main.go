@@ -2,16 +2,30 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	botservice "go_mod/bot"
 	"go_mod/config"
-	"log"
+	"go_mod/dispatcher"
+	"go_mod/health"
+	"go_mod/logging"
+	"go_mod/metrics"
+	"go_mod/outbox"
+	"go_mod/tracing"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	asynq "github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	redis "github.com/redis/go-redis/v9"
 
-	"github.com/fatih/color"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -19,102 +33,311 @@ import (
 )
 
 func main() {
-	green := color.New(color.FgGreen).SprintFunc()
-	red := color.New(color.FgRed).SprintFunc()
+	envErr := godotenv.Load()
 
-	if err := godotenv.Load(); err != nil {
-		log.Println(red("No .env file found, using environment variables"))
+	cfg, err := config.LoadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cfg.PrintConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, cfg.LogLevel, cfg.LogRedact)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	slog.SetDefault(logger)
+	tgbotapi.SetLogger(logging.TelegramLogger{Logger: logger, Redact: cfg.LogRedact})
 
-	cfg := config.LoadConfig()
+	if envErr != nil {
+		slog.Info("No .env file found, using environment variables")
+	}
 
-	bot, err := tgbotapi.NewBotAPI(cfg.TelegramToken)
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:     cfg.TraceExporter,
+		File:         cfg.TraceFile,
+		OTLPEndpoint: cfg.TraceOTLPEndpoint,
+		ServiceName:  "task-scheduler-bot",
+	})
 	if err != nil {
-		log.Fatal(red("Failed to initialize Telegram Bot API: %s", err))
-		return
+		fatal("Failed to set up tracing", err)
+	}
+
+	location, err := time.LoadLocation(cfg.ReminderTimezone)
+	if err != nil {
+		fatal("Failed to load reminder time zone", err)
+	}
+	admins, err := cfg.Admins()
+	if err != nil {
+		fatal("Failed to parse admin IDs", err)
+	}
+	if err := botservice.CheckCatalogs(); err != nil {
+		fatal("Message catalogs are inconsistent", err)
+	}
+	if !slices.Contains(botservice.Languages(), cfg.DefaultLanguage) {
+		fatal("Unknown default language", fmt.Errorf("DEFAULT_LANGUAGE must be one of %v, got %q", botservice.Languages(), cfg.DefaultLanguage))
 	}
 
-	bot.Debug = true
+	// ctx carries all in-flight work and is only cancelled when the shutdown drain times out
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	log.Println(green("Authorized on account %s", bot.Self.UserName))
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
-	clientOptions := options.Client().ApplyURI(cfg.MongoDBURI)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	startedAt := time.Now()
+	pollTracker := &health.PollTracker{Client: &http.Client{}}
+	bot, err := tgbotapi.NewBotAPIWithClient(cfg.TelegramToken, tgbotapi.APIEndpoint, pollTracker)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to initialize Telegram Bot API", err)
 	}
-	defer func() {
-		if err := client.Disconnect(context.TODO()); err != nil {
-			panic(err)
-		}
-	}()
 
-	err = client.Ping(context.TODO(), nil)
+	bot.Debug = cfg.TelegramDebug
+
+	slog.Info("Authorized on Telegram", "account", bot.Self.UserName)
+
+	clientOptions := options.Client().ApplyURI(cfg.MongoDBURI).SetMonitor(tracing.MongoMonitor(metrics.MongoMonitor()))
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatal(red(err))
+		fatal("Failed to connect to MongoDB", err)
 	}
 
-	fmt.Println(green("Connected to MongoDB!"))
-	go botservice.CreateIndexes(client, cfg.MongoDBDatabase, "tasks")
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		fatal("Failed to ping MongoDB", err)
+	}
+
+	slog.Info("Connected to MongoDB")
+	go func() {
+		if err := botservice.CreateIndexes(ctx, client, cfg.MongoDBDatabase, cfg.MongoDBCollection); err != nil {
+			slog.Error("Failed to create indexes", "error", err)
+		}
+	}()
 
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     cfg.RedisURI,
 		Password: cfg.RedisPassword,
 		DB:       cfg.RedisDB,
 	})
+	rdb.AddHook(metrics.RedisHook{})
+	rdb.AddHook(tracing.RedisHook{})
 
-	pong, err := rdb.Ping(context.Background()).Result()
-	if err != nil {
-		log.Fatal(red("Failed to connect to Redis: %s", err))
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		fatal("Failed to connect to Redis", err)
 	}
-	fmt.Println(green("Connected to Redis!\n", pong))
+	slog.Info("Connected to Redis")
 
-	clientAsynq := asynq.NewClient(asynq.RedisClientOpt{Addr: cfg.RedisURI, Password: cfg.RedisPassword, DB: cfg.RedisDB})
-	defer clientAsynq.Close()
+	redisOpt := asynq.RedisClientOpt{Addr: cfg.RedisURI, Password: cfg.RedisPassword, DB: cfg.RedisDB}
+	clientAsynq := asynq.NewClient(redisOpt)
+	inspector := asynq.NewInspector(redisOpt)
+	prometheus.MustRegister(metrics.NewQueueCollector(inspector))
 
 	srv := asynq.NewServer(
-		asynq.RedisClientOpt{Addr: cfg.RedisURI, Password: cfg.RedisPassword, DB: cfg.RedisDB},
+		redisOpt,
 		asynq.Config{
-			Concurrency: 10,
+			Concurrency: cfg.AsynqConcurrency,
+			Logger:      logging.AsynqLogger{Logger: logger},
 		})
 
-	collection := client.Database(cfg.MongoDBDatabase).Collection("tasks")
-	botService := botservice.NewBotService(bot, collection, rdb, clientAsynq)
+	collection := client.Database(cfg.MongoDBDatabase).Collection(cfg.MongoDBCollection)
+	sender := outbox.New(bot, outbox.Options{
+		GlobalRate: float64(cfg.TelegramGlobalRate),
+		ChatRate:   float64(cfg.TelegramChatRate),
+		Workers:    cfg.OutboxWorkers,
+		MaxQueue:   cfg.OutboxMaxQueue,
+		MaxRetries: cfg.OutboxMaxRetries,
+	})
+	senderCtx, stopSender := context.WithCancel(context.Background())
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		sender.Run(senderCtx)
+	}()
+
+	botService := botservice.NewBotService(bot, collection, rdb, clientAsynq, sender, botservice.Options{
+		MongoTimeout:    cfg.MongoTimeout,
+		RedisTimeout:    cfg.RedisTimeout,
+		CommandStateTTL: cfg.CommandStateTTL,
+		Location:        location,
+		Limits: botservice.Limits{
+			Read:                 cfg.RateLimitRead,
+			Write:                cfg.RateLimitWrite,
+			Other:                cfg.RateLimitOther,
+			Window:               cfg.RateLimitWindow,
+			Strikes:              cfg.RateLimitStrikes,
+			BanDuration:          cfg.BanDuration,
+			MaxTasks:             cfg.MaxTasksPerChat,
+			MaxDescriptionLength: cfg.MaxDescriptionLength,
+			Admins:               admins,
+		},
+		PageSize:        cfg.ListPageSize,
+		DefaultLanguage: cfg.DefaultLanguage,
+		CalendarURL:     cfg.CalendarBaseURL,
+	})
 
-	command, err := botService.GetCommandState(bot.Self.ID)
+	command, err := botService.GetCommandState(ctx, bot.Self.ID)
 	if err != nil {
-		log.Println(red("Ошибка при получении состояния команды:", err))
+		slog.Error("Ошибка при получении состояния команды", "error", err)
 	} else if command != "" {
-		log.Println(green("Текущая команда пользователя:", command))
-	}
-
-	taskHandler := func(ctx context.Context, t *asynq.Task) error {
-		var taskInfo botservice.Task
-		if err := json.Unmarshal(t.Payload(), &taskInfo); err != nil {
-			return fmt.Errorf("json.Unmarshal failed: %v", err)
-		}
-		return nil
+		slog.Info("Текущая команда пользователя", "command", command)
 	}
 
 	mux := asynq.NewServeMux()
-	mux.HandleFunc("reminder:send", taskHandler)
+	mux.HandleFunc(botservice.ReminderTaskType, botService.HandleReminderTask)
 
+	if err := srv.Start(mux); err != nil {
+		fatal("Asynq server failed to start", err)
+	}
+	var asynqRunning atomic.Bool
+	asynqRunning.Store(true)
+
+	reminderCtx, stopReminder := context.WithCancel(ctx)
+	reminderDone := make(chan struct{})
 	go func() {
-		if err := srv.Run(mux); err != nil {
-			log.Fatal(red("Asynq server failed to start: %v", err))
-		}
+		defer close(reminderDone)
+		botService.StartReminder(reminderCtx, cfg.ReminderIntervalMinutes, clientAsynq)
 	}()
 
-	go botService.StartReminder(cfg.ReminderIntervalMinutes, clientAsynq)
+	checker := health.NewChecker(cfg.HealthCheckTimeout)
+	checker.Add("mongo", func(ctx context.Context) error {
+		return client.Ping(ctx, nil)
+	})
+	checker.Add("redis", func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	})
+	checker.Add("asynq", func(ctx context.Context) error {
+		if !asynqRunning.Load() {
+			return errors.New("server is not running")
+		}
+		return srv.Ping()
+	})
+	checker.Add("telegram", pollTracker.Check(startedAt, cfg.TelegramPollMaxAge))
+
+	httpMux := http.NewServeMux()
+	httpMux.Handle("/metrics", promhttp.Handler())
+	httpMux.Handle("/healthz", checker.LivenessHandler())
+	httpMux.Handle("/readyz", checker.ReadinessHandler())
+	if cfg.CalendarBaseURL != "" {
+		httpMux.Handle("GET /calendar/", botService.CalendarHandler())
+	}
+	httpServer := &http.Server{Addr: cfg.HTTPAddr, Handler: httpMux}
+	if cfg.HTTPAddr != "" {
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("HTTP server failed", "error", err)
+			}
+		}()
+		slog.Info("Serving metrics and health endpoints", "addr", cfg.HTTPAddr)
+	}
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
-	updates := bot.GetUpdatesChan(u)
-	for update := range updates {
+	updateHandler := func(ctx context.Context, update tgbotapi.Update) {
 		if update.Message != nil {
-			log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
-			botService.HandleCommand(update.Message, clientAsynq)
+			slog.InfoContext(ctx, "Message received", "user", update.Message.From.UserName, "text", update.Message.Text)
+			botService.HandleCommand(ctx, update.Message, clientAsynq)
+		}
+		if update.CallbackQuery != nil {
+			slog.InfoContext(ctx, "Callback received", "user", update.CallbackQuery.From.UserName, "data", update.CallbackQuery.Data)
+			botService.HandleCallback(ctx, update.CallbackQuery)
+		}
+	}
+
+	disp := dispatcher.NewDispatcher(cfg.DispatcherWorkers, cfg.DispatcherQueueSize, cfg.HandlerTimeout, updateHandler)
+	disp.Start(ctx)
+
+	updates := bot.GetUpdatesChan(u)
+poll:
+	for {
+		select {
+		case <-sigCtx.Done():
+			break poll
+		case update, ok := <-updates:
+			if !ok {
+				break poll
+			}
+			if err := disp.Dispatch(sigCtx, update); err != nil {
+				slog.Warn("Failed to dispatch update", "update_id", update.UpdateID, "error", err)
+			}
 		}
 	}
+
+	slog.Info("Shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+
+	bot.StopReceivingUpdates()
+
+	drained := make(chan struct{})
+	go func() {
+		disp.Stop()
+		close(drained)
+	}()
+	if !waitFor(shutdownCtx, drained) {
+		slog.Warn("Timed out draining update handlers, cancelling in-flight work")
+		cancel()
+	}
+
+	asynqRunning.Store(false)
+	asynqStopped := make(chan struct{})
+	go func() {
+		srv.Shutdown()
+		close(asynqStopped)
+	}()
+	if !waitFor(shutdownCtx, asynqStopped) {
+		slog.Warn("Timed out stopping the asynq server")
+	}
+
+	stopReminder()
+	if !waitFor(shutdownCtx, reminderDone) {
+		slog.Warn("Timed out waiting for the reminder ticker to stop")
+	}
+
+	if err := sender.Drain(shutdownCtx); err != nil {
+		slog.Warn("Timed out flushing outgoing messages", "error", err)
+	}
+	stopSender()
+	<-senderDone
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to stop HTTP server", "error", err)
+	}
+	if err := inspector.Close(); err != nil {
+		slog.Error("Failed to close asynq inspector", "error", err)
+	}
+	if err := clientAsynq.Close(); err != nil {
+		slog.Error("Failed to close asynq client", "error", err)
+	}
+	if err := rdb.Close(); err != nil {
+		slog.Error("Failed to close Redis client", "error", err)
+	}
+	if err := client.Disconnect(shutdownCtx); err != nil {
+		slog.Error("Failed to disconnect from MongoDB", "error", err)
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+
+	slog.Info("Shutdown complete")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// waitFor reports whether done was closed before ctx expired.
+func waitFor(ctx context.Context, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	asynq "github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	redis "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const namespace = "task_bot"
+
+var (
+	UpdatesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_received_total",
+		Help:      "Telegram updates received, by command.",
+	}, []string{"command"})
+
+	HandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent handling one command.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+
+	TelegramSendErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_send_errors_total",
+		Help:      "Messages that Telegram refused or that failed to reach it.",
+	})
+
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of MongoDB and Redis operations.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"store", "operation", "status"})
+
+	RemindersEnqueued = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reminders_enqueued_total",
+		Help:      "Reminder tasks put on the asynq queue.",
+	})
+
+	RemindersDelivered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reminders_delivered_total",
+		Help:      "Reminder messages sent to users.",
+	})
+
+	RemindersFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reminders_failed_total",
+		Help:      "Reminders that could not be enqueued or delivered, by stage.",
+	}, []string{"stage"})
+
+	CheckDeadlinesDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "check_deadlines_duration_seconds",
+		Help:      "Duration of one deadline check pass.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+)
+
+// Since returns the seconds elapsed from start, for Observe calls.
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+func status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// MongoMonitor times every command the Mongo driver sends.
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			StorageDuration.WithLabelValues("mongo", e.CommandName, "ok").Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			StorageDuration.WithLabelValues("mongo", e.CommandName, "error").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// RedisHook times every command sent through a go-redis client.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		if err == redis.Nil {
+			err = nil
+		}
+		StorageDuration.WithLabelValues("redis", strings.ToLower(cmd.Name()), status(err)).Observe(Since(start))
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		StorageDuration.WithLabelValues("redis", "pipeline", status(err)).Observe(Since(start))
+		return err
+	}
+}
+
+var _ redis.Hook = RedisHook{}
+
+// QueueCollector reports asynq queue depth by task state at scrape time.
+type QueueCollector struct {
+	inspector *asynq.Inspector
+	depth     *prometheus.Desc
+}
+
+func NewQueueCollector(inspector *asynq.Inspector) *QueueCollector {
+	return &QueueCollector{
+		inspector: inspector,
+		depth: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "asynq", "queue_depth"),
+			"Tasks in an asynq queue, by state.",
+			[]string{"queue", "state"}, nil,
+		),
+	}
+}
+
+func (c *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+}
+
+func (c *QueueCollector) Collect(ch chan<- prometheus.Metric) {
+	queues, err := c.inspector.Queues()
+	if err != nil {
+		slog.Warn("Failed to list asynq queues", "error", err)
+		return
+	}
+	for _, queue := range queues {
+		info, err := c.inspector.GetQueueInfo(queue)
+		if err != nil {
+			slog.Warn("Failed to inspect asynq queue", "queue", queue, "error", err)
+			continue
+		}
+		states := map[string]int{
+			"pending":   info.Pending,
+			"active":    info.Active,
+			"scheduled": info.Scheduled,
+			"retry":     info.Retry,
+			"archived":  info.Archived,
+		}
+		for state, n := range states {
+			ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(n), queue, state)
+		}
+	}
+}
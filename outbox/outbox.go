@@ -0,0 +1,351 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"golang.org/x/time/rate"
+)
+
+// Priority orders queued messages. Lower values are sent first.
+type Priority int
+
+const (
+	// Interactive is for replies to something the user just did.
+	Interactive Priority = iota
+	// Bulk is for reminders and other messages nobody is waiting on.
+	Bulk
+)
+
+var ErrQueueFull = errors.New("outbox: queue is full")
+
+type priorityKey struct{}
+
+// WithPriority marks every message sent with ctx as prio. The default is Interactive.
+func WithPriority(ctx context.Context, prio Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, prio)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	if prio, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return prio
+	}
+	return Interactive
+}
+
+// API is the part of the Telegram client the outbox sends through.
+type API interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+}
+
+type Options struct {
+	// GlobalRate and ChatRate are in messages per second.
+	GlobalRate float64
+	ChatRate   float64
+	Workers    int
+	MaxQueue   int
+	MaxRetries int
+}
+
+type result struct {
+	msg tgbotapi.Message
+	err error
+}
+
+type item struct {
+	ctx       context.Context
+	chatID    int64
+	c         tgbotapi.Chattable
+	prio      Priority
+	seq       uint64
+	attempts  int
+	notBefore time.Time
+	done      chan result
+}
+
+type chatState struct {
+	limiter      *rate.Limiter
+	blockedUntil time.Time
+	inflight     bool
+	queued       int
+	lastUsed     time.Time
+}
+
+// Outbox sends Telegram messages through a global and a per-chat token bucket.
+// Messages for one chat are sent one at a time, in priority order, and a 429
+// response pauses that chat for the retry_after Telegram asks for.
+type Outbox struct {
+	api    API
+	opts   Options
+	global *rate.Limiter
+
+	mu          sync.Mutex
+	queue       []*item
+	chats       map[int64]*chatState
+	seq         uint64
+	lastCleanup time.Time
+	notify      chan struct{}
+}
+
+func New(api API, opts Options) *Outbox {
+	if opts.GlobalRate <= 0 {
+		opts.GlobalRate = 30
+	}
+	if opts.ChatRate <= 0 {
+		opts.ChatRate = 1
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.MaxQueue < 1 {
+		opts.MaxQueue = 1000
+	}
+	return &Outbox{
+		api:    api,
+		opts:   opts,
+		global: rate.NewLimiter(rate.Limit(opts.GlobalRate), int(opts.GlobalRate)),
+		chats:  make(map[int64]*chatState),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Send queues c for chatID and waits until it has been sent, has failed for good,
+// or ctx is done. The priority comes from ctx, see WithPriority.
+func (o *Outbox) Send(ctx context.Context, chatID int64, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	it := &item{
+		ctx:    ctx,
+		chatID: chatID,
+		c:      c,
+		prio:   priorityFrom(ctx),
+		done:   make(chan result, 1),
+	}
+
+	o.mu.Lock()
+	if len(o.queue) >= o.opts.MaxQueue {
+		o.mu.Unlock()
+		return tgbotapi.Message{}, ErrQueueFull
+	}
+	o.seq++
+	it.seq = o.seq
+	o.queue = append(o.queue, it)
+	o.chat(chatID).queued++
+	o.mu.Unlock()
+	o.wake()
+
+	select {
+	case res := <-it.done:
+		return res.msg, res.err
+	case <-ctx.Done():
+		return tgbotapi.Message{}, ctx.Err()
+	}
+}
+
+// Run starts the send workers and blocks until ctx is done.
+func (o *Outbox) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < o.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// Drain waits until nothing is queued or in flight, or ctx is done.
+func (o *Outbox) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		o.mu.Lock()
+		busy := len(o.queue) > 0
+		for _, cs := range o.chats {
+			busy = busy || cs.inflight
+		}
+		o.mu.Unlock()
+		if !busy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) wake() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// chat must be called with o.mu held.
+func (o *Outbox) chat(chatID int64) *chatState {
+	cs, ok := o.chats[chatID]
+	if !ok {
+		cs = &chatState{limiter: rate.NewLimiter(rate.Limit(o.opts.ChatRate), 1)}
+		o.chats[chatID] = cs
+	}
+	return cs
+}
+
+func (o *Outbox) work(ctx context.Context) {
+	for {
+		if err := o.global.Wait(ctx); err != nil {
+			return
+		}
+		it, err := o.next(ctx)
+		if err != nil {
+			return
+		}
+		o.deliver(it)
+	}
+}
+
+// next blocks until some queued message may be sent and removes it from the queue.
+func (o *Outbox) next(ctx context.Context) (*item, error) {
+	for {
+		o.mu.Lock()
+		now := time.Now()
+		o.cleanup(now)
+
+		best := -1
+		var wakeAt time.Time
+		for i, it := range o.queue {
+			cs := o.chat(it.chatID)
+			if cs.inflight {
+				continue
+			}
+			ready := it.notBefore
+			if cs.blockedUntil.After(ready) {
+				ready = cs.blockedUntil
+			}
+			if tokens := cs.limiter.TokensAt(now); tokens < 1 {
+				wait := time.Duration((1 - tokens) / o.opts.ChatRate * float64(time.Second))
+				if at := now.Add(wait); at.After(ready) {
+					ready = at
+				}
+			}
+			if ready.After(now) {
+				if wakeAt.IsZero() || ready.Before(wakeAt) {
+					wakeAt = ready
+				}
+				continue
+			}
+			if best < 0 || before(it, o.queue[best]) {
+				best = i
+			}
+		}
+
+		if best >= 0 {
+			it := o.queue[best]
+			o.queue = append(o.queue[:best], o.queue[best+1:]...)
+			cs := o.chat(it.chatID)
+			cs.queued--
+			cs.inflight = true
+			cs.limiter.AllowN(now, 1)
+			cs.lastUsed = now
+			o.mu.Unlock()
+			return it, nil
+		}
+		o.mu.Unlock()
+
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if !wakeAt.IsZero() {
+			timer = time.NewTimer(time.Until(wakeAt))
+			timerC = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-o.notify:
+		case <-timerC:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func before(a, b *item) bool {
+	if a.prio != b.prio {
+		return a.prio < b.prio
+	}
+	return a.seq < b.seq
+}
+
+// cleanup forgets idle chats once a minute. Must be called with o.mu held.
+func (o *Outbox) cleanup(now time.Time) {
+	if now.Sub(o.lastCleanup) < time.Minute {
+		return
+	}
+	o.lastCleanup = now
+	for id, cs := range o.chats {
+		if !cs.inflight && cs.queued == 0 && now.Sub(cs.lastUsed) > time.Minute && now.After(cs.blockedUntil) {
+			delete(o.chats, id)
+		}
+	}
+}
+
+func (o *Outbox) deliver(it *item) {
+	if err := it.ctx.Err(); err != nil {
+		o.finish(it, result{err: err})
+		return
+	}
+
+	msg, err := o.api.Send(it.c)
+	if err == nil {
+		o.finish(it, result{msg: msg})
+		return
+	}
+
+	var delay time.Duration
+	var apiErr *tgbotapi.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code == 429:
+		delay = time.Duration(apiErr.RetryAfter) * time.Second
+		if delay <= 0 {
+			delay = time.Second
+		}
+	case errors.As(err, &apiErr):
+		// Telegram rejected the message itself, sending it again will not help
+		o.finish(it, result{err: err})
+		return
+	default:
+		// network error, back off exponentially
+		delay = time.Duration(1<<it.attempts) * time.Second
+	}
+
+	it.attempts++
+	if it.attempts > o.opts.MaxRetries {
+		o.finish(it, result{err: err})
+		return
+	}
+
+	slog.WarnContext(it.ctx, "Telegram send failed, retrying", "chat_id", it.chatID, "attempt", it.attempts, "retry_in", delay, "error", err)
+	o.mu.Lock()
+	cs := o.chat(it.chatID)
+	cs.inflight = false
+	cs.blockedUntil = time.Now().Add(delay)
+	cs.queued++
+	it.notBefore = cs.blockedUntil
+	o.queue = append(o.queue, it)
+	o.mu.Unlock()
+	o.wake()
+}
+
+func (o *Outbox) finish(it *item, res result) {
+	o.mu.Lock()
+	o.chat(it.chatID).inflight = false
+	o.mu.Unlock()
+	o.wake()
+	it.done <- res
+}
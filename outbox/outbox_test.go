@@ -0,0 +1,213 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type sent struct {
+	chatID int64
+	text   string
+	at     time.Time
+}
+
+// fakeAPI records what was sent. fail, when set, decides which calls fail.
+type fakeAPI struct {
+	mu    sync.Mutex
+	sent  []sent
+	calls int
+	fail  func(call int, msg tgbotapi.MessageConfig) error
+}
+
+func (f *fakeAPI) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	msg := c.(tgbotapi.MessageConfig)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail != nil {
+		if err := f.fail(f.calls, msg); err != nil {
+			return tgbotapi.Message{}, err
+		}
+	}
+	f.sent = append(f.sent, sent{chatID: msg.ChatID, text: msg.Text, at: time.Now()})
+	return tgbotapi.Message{MessageID: len(f.sent), Text: msg.Text}, nil
+}
+
+func (f *fakeAPI) texts(chatID int64) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var texts []string
+	for _, s := range f.sent {
+		if s.chatID == chatID {
+			texts = append(texts, s.text)
+		}
+	}
+	return texts
+}
+
+// enqueue sends text to chatID in the background and waits until it is queued,
+// so messages queued one after another keep their order.
+func enqueue(t *testing.T, ctx context.Context, o *Outbox, chatID int64, text string) <-chan error {
+	t.Helper()
+	o.mu.Lock()
+	n := len(o.queue)
+	o.mu.Unlock()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := o.Send(ctx, chatID, tgbotapi.NewMessage(chatID, text))
+		errc <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		o.mu.Lock()
+		queued := len(o.queue) > n
+		o.mu.Unlock()
+		if queued {
+			return errc
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q was not queued", text)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func run(o *Outbox) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestSendKeepsChatOrderAndPriority(t *testing.T) {
+	api := &fakeAPI{}
+	o := New(api, Options{GlobalRate: 1000, ChatRate: 1000, Workers: 4})
+
+	bulk := WithPriority(context.Background(), Bulk)
+	var errs []<-chan error
+	for _, m := range []struct {
+		ctx    context.Context
+		chatID int64
+		text   string
+	}{
+		{bulk, 1, "reminder 1"},
+		{bulk, 2, "reminder 2"},
+		{context.Background(), 1, "reply 1"},
+		{bulk, 1, "reminder 3"},
+		{context.Background(), 1, "reply 2"},
+		{context.Background(), 2, "reply 3"},
+	} {
+		errs = append(errs, enqueue(t, m.ctx, o, m.chatID, m.text))
+	}
+	stop := run(o)
+	defer stop()
+	for _, errc := range errs {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := api.texts(1), []string{"reply 1", "reply 2", "reminder 1", "reminder 3"}; !slices.Equal(got, want) {
+		t.Errorf("chat 1 got %q, want %q", got, want)
+	}
+	if got, want := api.texts(2), []string{"reply 3", "reminder 2"}; !slices.Equal(got, want) {
+		t.Errorf("chat 2 got %q, want %q", got, want)
+	}
+}
+
+func TestSendWaitsRetryAfter(t *testing.T) {
+	api := &fakeAPI{fail: func(call int, msg tgbotapi.MessageConfig) error {
+		if call == 1 {
+			return &tgbotapi.Error{Code: 429, Message: "Too Many Requests", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 1}}
+		}
+		return nil
+	}}
+	o := New(api, Options{GlobalRate: 1000, ChatRate: 1000, MaxRetries: 3})
+	stop := run(o)
+	defer stop()
+
+	start := time.Now()
+	msg, err := o.Send(context.Background(), 1, tgbotapi.NewMessage(1, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "hello" {
+		t.Errorf("Send returned %q, want the sent message", msg.Text)
+	}
+	if api.calls != 2 {
+		t.Errorf("Send called the API %d times, want 2", api.calls)
+	}
+	if waited := api.sent[0].at.Sub(start); waited < time.Second {
+		t.Errorf("retried after %v, want at least the 1s retry_after", waited)
+	}
+}
+
+func TestSendGivesUpOnRejectedMessage(t *testing.T) {
+	rejected := &tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}
+	api := &fakeAPI{fail: func(call int, msg tgbotapi.MessageConfig) error {
+		return rejected
+	}}
+	o := New(api, Options{GlobalRate: 1000, ChatRate: 1000, MaxRetries: 3})
+	stop := run(o)
+	defer stop()
+
+	if _, err := o.Send(context.Background(), 1, tgbotapi.NewMessage(1, "hello")); !errors.Is(err, rejected) {
+		t.Errorf("Send = %v, want %v", err, rejected)
+	}
+	if api.calls != 1 {
+		t.Errorf("Send called the API %d times, want 1", api.calls)
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	o := New(&fakeAPI{}, Options{MaxQueue: 1})
+	enqueue(t, context.Background(), o, 1, "first")
+	if _, err := o.Send(context.Background(), 1, tgbotapi.NewMessage(1, "second")); err != ErrQueueFull {
+		t.Errorf("Send = %v, want %v", err, ErrQueueFull)
+	}
+}
+
+func TestDrainWaitsForQueuedMessages(t *testing.T) {
+	api := &fakeAPI{}
+	// one message per chat every 20ms, so the queue takes a while to empty
+	o := New(api, Options{GlobalRate: 1000, ChatRate: 50, Workers: 2})
+	for i := 0; i < 5; i++ {
+		enqueue(t, context.Background(), o, 1, "message")
+	}
+	stop := run(o)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := o.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(api.texts(1)); got != 5 {
+		t.Errorf("Drain returned after %d of 5 messages", got)
+	}
+}
+
+func TestDrainGivesUp(t *testing.T) {
+	o := New(&fakeAPI{}, Options{})
+	// nothing runs the outbox, so the message stays queued
+	enqueue(t, context.Background(), o, 1, "stuck")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := o.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain = %v, want %v", err, context.DeadlineExceeded)
+	}
+}